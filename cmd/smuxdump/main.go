@@ -0,0 +1,336 @@
+// Command smuxdump decodes the capture files written by smux.CaptureWriter.
+//
+//	smuxdump timeline [-session id] [-stream sid] capture.smx
+//	smuxdump stats [-session id] capture.smx
+//	smuxdump replay -session id [-version n] [-negotiate] capture.smx
+//
+// timeline prints the frames of every stream in order, stats counts frames
+// and bytes per command and per stream, replay feeds the frames received by
+// a session into a new server-side session and reports the accepted streams.
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/smux"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "timeline":
+		err = timeline(args)
+	case "stats":
+		err = stats(args)
+	case "replay":
+		err = replay(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "smuxdump:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: smuxdump timeline|stats|replay [flags] capture")
+	os.Exit(2)
+}
+
+// streamKey identifies a stream in a capture of several sessions
+type streamKey struct {
+	session uint64
+	sid     uint32
+}
+
+func (k streamKey) String() string {
+	if k.sid == 0 {
+		return fmt.Sprintf("session %d control", k.session)
+	}
+	return fmt.Sprintf("session %d stream %d", k.session, k.sid)
+}
+
+func compareKeys(a, b streamKey) int {
+	if a.session != b.session {
+		return cmp.Compare(a.session, b.session)
+	}
+	return cmp.Compare(a.sid, b.sid)
+}
+
+// parse parses the flags and opens the capture named by the last argument
+func parse(fs *flag.FlagSet, args []string) (*smux.CaptureReader, io.Closer, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, nil, errors.New("expecting one capture file")
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := smux.NewCaptureReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return reader, file, nil
+}
+
+// each calls fn for the frames of the capture
+func each(reader *smux.CaptureReader, fn func(f *smux.CapturedFrame)) error {
+	for {
+		f, err := reader.ReadFrame()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(f)
+	}
+}
+
+func timeline(args []string) error {
+	fs := flag.NewFlagSet("timeline", flag.ExitOnError)
+	session := fs.Uint64("session", 0, "only the frames of this session")
+	sid := fs.Int64("stream", -1, "only the frames of this stream, 0 for control frames")
+	reader, file, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var start time.Time
+	frames := make(map[streamKey][]*smux.CapturedFrame)
+	err = each(reader, func(f *smux.CapturedFrame) {
+		if start.IsZero() {
+			start = f.Time
+		}
+		if (*session != 0 && f.Session != *session) || (*sid >= 0 && int64(f.StreamID) != *sid) {
+			return
+		}
+		key := streamKey{session: f.Session, sid: f.StreamID}
+		if f.Hello() {
+			key.sid = 0
+		}
+		frames[key] = append(frames[key], f)
+	})
+
+	keys := slices.SortedFunc(maps.Keys(frames), compareKeys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s:\n", key)
+		for _, f := range frames[key] {
+			cmd := f.Command()
+			if f.Hello() {
+				cmd = "HELLO"
+			}
+			fmt.Fprintf(w, "  %v\t%s\tv%d\t%s\t%d\t%s\n",
+				f.Time.Sub(start), f.Direction, f.Version, cmd, f.Length, preview(f.Payload))
+		}
+	}
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// preview prints the beginning of a payload
+func preview(payload []byte) string {
+	const size = 16
+	if len(payload) > size {
+		return fmt.Sprintf("%q...", payload[:size])
+	} else if len(payload) > 0 {
+		return fmt.Sprintf("%q", payload)
+	}
+	return ""
+}
+
+// counter sums frames and bytes, headers included
+type counter struct {
+	frames, bytes uint64
+}
+
+func (c *counter) add(f *smux.CapturedFrame) {
+	header := 8
+	if f.Version >= 3 {
+		header += 2 // high bits of the length
+	}
+	c.frames++
+	c.bytes += uint64(header + f.Length)
+}
+
+// streamStats summarizes a stream
+type streamStats struct {
+	first, last time.Time
+	in, out     counter
+	end         string // how the stream ended
+}
+
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	session := fs.Uint64("session", 0, "only the frames of this session")
+	reader, file, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	type cmdKey struct {
+		dir smux.Direction
+		cmd string
+	}
+	cmds := make(map[cmdKey]*counter)
+	streams := make(map[streamKey]*streamStats)
+	var total counter
+	err = each(reader, func(f *smux.CapturedFrame) {
+		if *session != 0 && f.Session != *session {
+			return
+		}
+		total.add(f)
+		ck := cmdKey{dir: f.Direction, cmd: f.Command()}
+		if cmds[ck] == nil {
+			cmds[ck] = new(counter)
+		}
+		cmds[ck].add(f)
+		if f.StreamID == 0 || f.Hello() {
+			return
+		}
+
+		key := streamKey{session: f.Session, sid: f.StreamID}
+		st := streams[key]
+		if st == nil {
+			st = &streamStats{first: f.Time}
+			streams[key] = st
+		}
+		st.last = f.Time
+		if f.Direction == smux.Inbound {
+			st.in.add(f)
+		} else {
+			st.out.add(f)
+		}
+		switch f.Command() {
+		case "FIN", "RST":
+			st.end = f.Command() + " " + f.Direction.String()
+		}
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%d frames, %d bytes\n\n", total.frames, total.bytes)
+	fmt.Fprintln(w, "DIR\tCMD\tFRAMES\tBYTES")
+	for _, ck := range slices.SortedFunc(maps.Keys(cmds), func(a, b cmdKey) int {
+		if a.dir != b.dir {
+			return cmp.Compare(a.dir, b.dir)
+		}
+		return cmp.Compare(a.cmd, b.cmd)
+	}) {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", ck.dir, ck.cmd, cmds[ck].frames, cmds[ck].bytes)
+	}
+
+	fmt.Fprintln(w, "\nSESSION\tSTREAM\tDURATION\tIN FRAMES\tIN BYTES\tOUT FRAMES\tOUT BYTES\tEND")
+	for _, key := range slices.SortedFunc(maps.Keys(streams), compareKeys) {
+		st := streams[key]
+		fmt.Fprintf(w, "%d\t%d\t%v\t%d\t%d\t%d\t%d\t%s\n", key.session, key.sid, st.last.Sub(st.first),
+			st.in.frames, st.in.bytes, st.out.frames, st.out.bytes, st.end)
+	}
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	session := fs.Uint64("session", 0, "replay the frames received by this session")
+	version := fs.Int("version", smux.DefaultConfig().Version, "protocol version of the session")
+	negotiate := fs.Bool("negotiate", false, "the captured session negotiated the version")
+	wait := fs.Duration("wait", 5*time.Second, "how long to wait for the streams to end once replayed")
+	reader, file, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if *session == 0 {
+		return errors.New("-session is required")
+	}
+
+	peer, conn := net.Pipe()
+	opts := []smux.Option{smux.WithVersion(*version), smux.WithoutKeepAlive()}
+	if *negotiate {
+		opts = append(opts, smux.WithNegotiation())
+	}
+	sess, err := smux.NewServer(conn, opts...)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+	ended := make(chan struct{}, 16)
+	go func() {
+		for {
+			stream, err := sess.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				n, err := io.Copy(io.Discard, stream)
+				fmt.Printf("stream %d %v: %d bytes, %v\n", stream.ID(), stream.Metadata(), n, endOf(err))
+				ended <- struct{}{}
+			}()
+		}
+	}()
+
+	var syns int
+	n, err := reader.Replay(peer, func(f *smux.CapturedFrame) bool {
+		if f.Session != *session || f.Direction != smux.Inbound {
+			return false
+		}
+		if f.Command() == "SYN" {
+			syns++
+		}
+		return true
+	})
+	fmt.Printf("%d frames replayed\n", n)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.After(*wait)
+waiting:
+	for ; syns > 0; syns-- {
+		select {
+		case <-ended:
+		case <-timeout:
+			fmt.Printf("%d streams have not ended\n", syns)
+			break waiting
+		}
+	}
+	if reason := sess.CloseReason(); reason != nil {
+		fmt.Printf("session failed: %v\n", reason)
+	}
+	return nil
+}
+
+// endOf describes how a replayed stream ended
+func endOf(err error) string {
+	if err == nil {
+		return "EOF"
+	}
+	return err.Error()
+}
@@ -19,12 +19,16 @@ type Allocator struct {
 	buffers []sync.Pool
 }
 
-// NewAllocator initiates a []byte allocator for frames less than 65536 bytes,
+// maxAllocBits bounds the buffers of the allocator, the largest frames of
+// protocol version 3 fit
+const maxAllocBits = 24
+
+// NewAllocator initiates a []byte allocator for frames up to 16MB,
 // the waste(memory fragmentation) of space allocation is guaranteed to be
 // no more than 50%.
 func NewAllocator() *Allocator {
 	alloc := new(Allocator)
-	alloc.buffers = make([]sync.Pool, 17) // 1B -> 64K
+	alloc.buffers = make([]sync.Pool, maxAllocBits+1) // 1B -> 16M
 	for k := range alloc.buffers {
 		i := k
 		alloc.buffers[k].New = func() interface{} {
@@ -36,7 +40,7 @@ func NewAllocator() *Allocator {
 
 // Get a []byte from pool with most appropriate cap
 func (alloc *Allocator) Get(size int) []byte {
-	if size <= 0 || size > 65536 {
+	if size <= 0 || size > 1<<maxAllocBits {
 		return nil
 	}
 
@@ -52,7 +56,7 @@ func (alloc *Allocator) Get(size int) []byte {
 // which the cap must be exactly 2^n
 func (alloc *Allocator) Put(buf []byte) error {
 	bits := msb(cap(buf))
-	if cap(buf) == 0 || cap(buf) > 65536 || cap(buf) != 1<<bits {
+	if cap(buf) == 0 || cap(buf) > 1<<maxAllocBits || cap(buf) != 1<<bits {
 		return errors.New("allocator Put() incorrect buffer size")
 	}
 	alloc.buffers[bits].Put(buf)
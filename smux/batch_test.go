@@ -0,0 +1,153 @@
+package smux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// holdingConn holds the writes until released, and counts them
+type holdingConn struct {
+	net.Conn
+	hold   atomic.Pointer[chan struct{}]
+	held   atomic.Bool // a write is held
+	writes atomic.Int64
+}
+
+func (c *holdingConn) Write(b []byte) (int, error) {
+	if hold := c.hold.Load(); hold != nil {
+		c.held.Store(true)
+		<-*hold
+	}
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestStreamReadFrom(t *testing.T) {
+	config := DefaultConfig()
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf, _ := io.ReadAll(remote)
+		received <- buf
+	}()
+
+	// hide WriteTo of bytes.Reader so that io.Copy uses ReadFrom
+	n, err := io.Copy(local, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d bytes, %v", n, err)
+	}
+	_ = local.Close()
+	if buf := <-received; !bytes.Equal(buf, data) {
+		t.Fatalf("received %d bytes, corrupted", len(buf))
+	}
+	// full frames straight from the reader, the window of protocol
+	// version 2 may split them
+	if frames := cli.Stats().SentByCmd["PSH"].Frames; frames != uint64(len(data)/config.MaxFrameSize) {
+		t.Fatalf("sent %d frames", frames)
+	}
+}
+
+func TestSendLoopBatch(t *testing.T) {
+	for name, config := range map[string]func(*Config){
+		"plain":  func(*Config) {},
+		"secret": func(c *Config) { c.Secret = []byte("batch") },
+		"passwd": func(c *Config) { c.Passwd = []byte("batch") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			conn := &holdingConn{Conn: a}
+			cliConfig, srvConfig := DefaultConfig(), DefaultConfig()
+			config(cliConfig)
+			config(srvConfig)
+			cli := Client(conn, cliConfig)
+			srv := Server(b, srvConfig)
+			t.Cleanup(func() {
+				_ = cli.Close()
+				_ = srv.Close()
+			})
+
+			const streams = 8
+			var locals, remotes []*Stream
+			for i := 0; i < streams; i++ {
+				local, remote := openPair(t, cli, srv)
+				locals = append(locals, local)
+				remotes = append(remotes, remote)
+			}
+
+			// the frames queue up while the connection is busy
+			hold := make(chan struct{})
+			release := sync.OnceFunc(func() {
+				conn.hold.Store(nil)
+				close(hold)
+			})
+			t.Cleanup(release)
+			conn.hold.Store(&hold)
+			conn.writes.Store(0)
+			go func() { _, _ = locals[0].Write([]byte("tick")) }()
+			waitFor(t, "the first frame to be held", conn.held.Load)
+			for _, local := range locals[1:] {
+				go func() { _, _ = local.Write([]byte("tick")) }()
+			}
+			waitFor(t, "the frames to queue up", func() bool {
+				return cli.Stats().ShaperQueue == streams-1
+			})
+			release()
+
+			buf := make([]byte, 4)
+			for _, remote := range remotes {
+				_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "tick" {
+					t.Fatalf("read %q, %v", buf, err)
+				}
+			}
+			// the first frame was held, the others go at once
+			if w := conn.writes.Load(); w != 2 {
+				t.Fatalf("%d writes for %d frames", w, streams)
+			}
+		})
+	}
+}
+
+func TestSendLoopWritev(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := Client(conn, DefaultConfig())
+	srv := Server(<-accepted, DefaultConfig())
+	defer cli.Close()
+	defer srv.Close()
+
+	local, remote := openPair(t, cli, srv)
+	data := bytes.Repeat([]byte("writev"), 100000)
+	go func() {
+		_, _ = local.Write(data)
+		_ = local.Close()
+	}()
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if buf, err := io.ReadAll(remote); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("read %d bytes, %v", len(buf), err)
+	}
+}
@@ -0,0 +1,188 @@
+package smux
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// budgetLeft marks the usage of a session which left its budget
+const budgetLeft = math.MinInt64 / 2
+
+// MemoryBudget caps the receive buffers of many sessions together, such as
+// all the sessions of a broker, on top of their own MaxReceiveBuffer.
+//
+// Every session sharing the budget is granted a fair share of it, the limit
+// divided by the number of sessions. A session keeps on reading below its
+// share, and past it as long as the budget is not exhausted, otherwise it
+// stops reading from its connection until memory is freed, which pushes
+// back on the peer. Thus the limit may be overshot by the sessions still
+// below their share, and by one frame per session, but the sessions
+// hoarding memory can't starve the others.
+type MemoryBudget struct {
+	limit    atomic.Int64
+	used     atomic.Int64
+	sessions atomic.Int64
+
+	mu        sync.Mutex
+	waiters   map[*Session]struct{} // sessions paused, woken up when memory is freed
+	nwaiters  atomic.Int64
+	throttled atomic.Uint64
+}
+
+// BudgetStats reports the pressure on a MemoryBudget.
+type BudgetStats struct {
+	Limit     int     `json:"limit"`     // bytes
+	Used      int     `json:"used"`      // bytes buffered by the sessions
+	Sessions  int     `json:"sessions"`  // sessions sharing the budget
+	Share     int     `json:"share"`     // fair share of a session in bytes
+	Pressure  float64 `json:"pressure"`  // used over limit, above 1 when overshot
+	Waiting   int     `json:"waiting"`   // sessions paused right now
+	Throttled uint64  `json:"throttled"` // times a session was paused
+}
+
+// NewMemoryBudget creates a budget of limit bytes, to be shared by sessions
+// through Config.MemoryBudget.
+func NewMemoryBudget(limit int) *MemoryBudget {
+	b := &MemoryBudget{waiters: make(map[*Session]struct{})}
+	b.limit.Store(int64(max(limit, 1)))
+	return b
+}
+
+// SetLimit changes the limit, the sessions paused resume if it's raised.
+func (b *MemoryBudget) SetLimit(limit int) {
+	b.limit.Store(int64(max(limit, 1)))
+	b.wake()
+}
+
+// Limit returns the limit in bytes.
+func (b *MemoryBudget) Limit() int {
+	return int(b.limit.Load())
+}
+
+// Pressure returns the memory used over the limit, from 0 for an idle
+// budget, up to 1 once exhausted, beyond when overshot.
+func (b *MemoryBudget) Pressure() float64 {
+	return float64(b.used.Load()) / float64(b.limit.Load())
+}
+
+// Stats returns a snapshot of the budget.
+func (b *MemoryBudget) Stats() BudgetStats {
+	return BudgetStats{
+		Limit:     int(b.limit.Load()),
+		Used:      int(b.used.Load()),
+		Sessions:  int(b.sessions.Load()),
+		Share:     int(b.share()),
+		Pressure:  b.Pressure(),
+		Waiting:   int(b.nwaiters.Load()),
+		Throttled: b.throttled.Load(),
+	}
+}
+
+// share returns the fair share of a session
+func (b *MemoryBudget) share() int64 {
+	return b.limit.Load() / max(b.sessions.Load(), 1)
+}
+
+// join adds a new session to the budget
+func (b *MemoryBudget) join() {
+	b.sessions.Add(1)
+}
+
+// leave frees the memory still held by a closed session, the shares of the
+// others grow
+func (b *MemoryBudget) leave(s *Session) {
+	used := s.budgetUsed.Swap(budgetLeft)
+	if used < 0 {
+		return // already left
+	}
+	b.used.Add(-used)
+	b.sessions.Add(-1)
+	b.wake()
+}
+
+// take charges n bytes buffered by the session
+func (b *MemoryBudget) take(s *Session, n int) {
+	for {
+		used := s.budgetUsed.Load()
+		if used < 0 {
+			return
+		}
+		if s.budgetUsed.CompareAndSwap(used, used+int64(n)) {
+			b.used.Add(int64(n))
+			return
+		}
+	}
+}
+
+// release returns n bytes consumed from the session
+func (b *MemoryBudget) release(s *Session, n int) {
+	for {
+		used := s.budgetUsed.Load()
+		if used < 0 {
+			return // freed when it left
+		}
+		freed := min(int64(n), used)
+		if s.budgetUsed.CompareAndSwap(used, used-freed) {
+			if b.used.Add(-freed) < b.limit.Load() && b.nwaiters.Load() > 0 {
+				b.wake()
+			}
+			return
+		}
+	}
+}
+
+// ready checks if the session may read another frame, if not it's paused
+// until woken up by notifyBucket
+func (b *MemoryBudget) ready(s *Session) bool {
+	if b.allows(s) {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// check again under the lock, wake can't be missed
+	if b.used.Load() < b.limit.Load() {
+		return true
+	}
+	if _, ok := b.waiters[s]; !ok {
+		b.waiters[s] = struct{}{}
+		b.nwaiters.Add(1)
+		b.throttled.Add(1)
+	}
+	return false
+}
+
+// allows checks if the session is below its share or the budget not exhausted
+func (b *MemoryBudget) allows(s *Session) bool {
+	return s.budgetUsed.Load() < b.share() || b.used.Load() < b.limit.Load()
+}
+
+// wake resumes the sessions paused
+func (b *MemoryBudget) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.waiters {
+		s.notifyBucket()
+	}
+	clear(b.waiters)
+	b.nwaiters.Store(0)
+}
+
+// receiveReady checks if recvLoop may read another frame
+func (s *Session) receiveReady() bool {
+	return atomic.LoadInt32(&s.bucket) > 0 && (s.budget == nil || s.budget.ready(s))
+}
+
+// receivePaused checks if recvLoop waits for tokens, without pausing it
+func (s *Session) receivePaused() bool {
+	return atomic.LoadInt32(&s.bucket) <= 0 || (s.budget != nil && !s.budget.allows(s))
+}
+
+// takeTokens accounts for n bytes buffered for the streams
+func (s *Session) takeTokens(n int) {
+	atomic.AddInt32(&s.bucket, -int32(n))
+	if s.budget != nil {
+		s.budget.take(s, n)
+	}
+}
@@ -0,0 +1,121 @@
+package smux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const limit = 64 << 10
+	budget := NewMemoryBudget(limit)
+	newPair := func() (*Session, *Session) {
+		a, b := net.Pipe()
+		cli := Client(a, DefaultConfig())
+		config := DefaultConfig()
+		config.MemoryBudget = budget
+		srv := Server(b, config)
+		t.Cleanup(func() {
+			_ = cli.Close()
+			_ = srv.Close()
+		})
+		return cli, srv
+	}
+	cli1, srv1 := newPair()
+	cli2, srv2 := newPair()
+
+	// the first session hoards memory, nobody reads its stream
+	hog, hogged := openPair(t, cli1, srv1)
+	data := make([]byte, 1<<20)
+	written := make(chan error, 1)
+	go func() {
+		_, err := hog.Write(data)
+		written <- err
+	}()
+	waitFor(t, "the budget to be exhausted", func() bool {
+		return budget.Stats().Waiting == 1
+	})
+	stats := budget.Stats()
+	if stats.Sessions != 2 || stats.Share != limit/2 || stats.Throttled == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Used > limit+DefaultConfig().MaxFrameSize || stats.Pressure < 1 {
+		t.Fatalf("budget overshot: %+v", stats)
+	}
+
+	// the second session is below its share
+	local, remote := openPair(t, cli2, srv2)
+	go func() { _, _ = local.Write([]byte("fair share")) }()
+	buf := make([]byte, 10)
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "fair share" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	// reading resumes the first session
+	_ = hogged.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(hogged, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if stats := srv1.Stats(); stats.Budget == nil || stats.Budget.Used != 0 {
+		t.Fatalf("unexpected session stats %+v", stats.Budget)
+	}
+
+	_ = srv1.Close()
+	_ = srv2.Close()
+	if stats := budget.Stats(); stats.Sessions != 0 || stats.Used != 0 {
+		t.Fatalf("budget not freed: %+v", stats)
+	}
+}
+
+func TestMemoryBudgetClose(t *testing.T) {
+	budget := NewMemoryBudget(1 << 20)
+	config := DefaultConfig()
+	config.MemoryBudget = budget
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+	go func() { _, _ = local.Write(make([]byte, 4096)) }()
+	waitFor(t, "data to be buffered", func() bool {
+		return srv.budgetUsed.Load() == 4096
+	})
+
+	// buffers of a closed session are freed once, late reads don't count
+	_ = srv.Close()
+	_, _ = remote.Read(make([]byte, 1024))
+	if stats := budget.Stats(); stats.Used != 0 || stats.Sessions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMemoryBudgetFailure(t *testing.T) {
+	budget := NewMemoryBudget(1 << 20)
+	config := DefaultConfig()
+	config.MemoryBudget = budget
+	cli, srv := newSessionPair(t, config)
+	local, _ := openPair(t, cli, srv)
+	_, _ = local.Write(make([]byte, 4096))
+	waitFor(t, "data to be buffered", func() bool {
+		return srv.budgetUsed.Load() == 4096
+	})
+
+	// sessions failing on a broken connection leave without Close
+	_ = cli.conn.Close()
+	waitFor(t, "the sessions to leave", func() bool {
+		stats := budget.Stats()
+		return stats.Used == 0 && stats.Sessions == 0
+	})
+}
@@ -0,0 +1,375 @@
+package smux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captureMagic starts a capture file, the last byte is the format version
+var captureMagic = [8]byte{'S', 'M', 'X', 'C', 'A', 'P', 0, 1}
+
+const (
+	// record flags
+	captureInbound = 1 << iota // received from the peer, sent otherwise
+	capturePayload             // the payload follows
+
+	// fixed part of a record, format:
+	// |1B flags|8B unix nano|8B session id|1B ver|1B cmd|4B sid|
+	captureHeaderSize = 1 + 8 + 8 + 1 + 1 + 4
+
+	// largest frame length accepted in a capture
+	maxCaptureLength = maxLargeFrameSize
+
+	// frames of the sessions waiting to be written, the ones beyond are
+	// dropped so that a slow capture never holds back the sessions
+	captureBacklog      = 4096
+	captureBacklogBytes = 8 << 20
+)
+
+var (
+	ErrInvalidCapture   = errors.New("invalid capture")
+	ErrCaptureNoPayload = errors.New("capture has no payloads")
+)
+
+// Direction tells whether a captured frame was sent or received.
+type Direction uint8
+
+const (
+	Outbound Direction = iota
+	Inbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "in"
+	}
+	return "out"
+}
+
+// CapturedFrame is a decoded frame recorded by a CaptureWriter, after
+// decryption and before decompression, as it is exchanged by the sessions.
+type CapturedFrame struct {
+	Time      time.Time
+	Session   uint64 // Session.ID of the capturing session
+	Direction Direction
+	Version   byte
+	Cmd       byte
+	StreamID  uint32
+	Length    int
+	Payload   []byte // nil unless payloads are captured
+}
+
+// Command returns the name of the command, e.g. "PSH".
+func (f *CapturedFrame) Command() string {
+	if int(f.Cmd) < len(cmdNames) {
+		return cmdNames[f.Cmd]
+	}
+	return fmt.Sprintf("CMD(%d)", f.Cmd)
+}
+
+// Hello checks if the frame is the HELLO of the version negotiation.
+func (f *CapturedFrame) Hello() bool {
+	return f.Cmd == cmdNOP && isHello(f.StreamID)
+}
+
+func (f *CapturedFrame) String() string {
+	return fmt.Sprintf("%s %s Version:%d Cmd:%s StreamID:%d Length:%d",
+		f.Time.Format(time.RFC3339Nano), f.Direction, f.Version, f.Command(), f.StreamID, f.Length)
+}
+
+// CaptureWriter writes the frames of one or several sessions to a capture
+// file, it's safe for concurrent use. Set it with Config.Capture or
+// Session.SetCapture, and read the file back with CaptureReader.
+//
+// The frames of the sessions are queued and written in the background,
+// they are dropped if the capture falls behind, see Dropped.
+type CaptureWriter struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	payloads bool
+	err      error
+	failed   atomic.Bool // err is set
+
+	qmu     sync.Mutex
+	queue   []*CapturedFrame // frames of the sessions to be written
+	queued  int              // payload bytes in queue
+	writing bool             // flag writeLoop is running
+	idle    *sync.Cond       // signaled when writeLoop stops
+	dropped atomic.Uint64
+}
+
+// NewCaptureWriter writes the capture file header to w, payloads tells
+// whether frame payloads are recorded, they are required to replay the
+// capture. Flush must be called once done.
+func NewCaptureWriter(w io.Writer, payloads bool) (*CaptureWriter, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(captureMagic[:]); err != nil {
+		return nil, err
+	}
+	c := &CaptureWriter{w: bw, payloads: payloads}
+	c.idle = sync.NewCond(&c.qmu)
+	return c, nil
+}
+
+// Payloads tells whether frame payloads are recorded.
+func (c *CaptureWriter) Payloads() bool {
+	return c.payloads
+}
+
+// WriteFrame records a frame, the payload is dropped unless payloads are
+// captured. The first write error is returned by all later calls.
+func (c *CaptureWriter) WriteFrame(f *CapturedFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+
+	var hdr [captureHeaderSize + 2*binary.MaxVarintLen64]byte
+	if f.Direction == Inbound {
+		hdr[0] |= captureInbound
+	}
+	payload := c.payloads && f.Payload != nil
+	if payload {
+		hdr[0] |= capturePayload
+	}
+	binary.LittleEndian.PutUint64(hdr[1:], uint64(f.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(hdr[9:], f.Session)
+	hdr[17] = f.Version
+	hdr[18] = f.Cmd
+	binary.LittleEndian.PutUint32(hdr[19:], f.StreamID)
+	n := captureHeaderSize
+	n += binary.PutUvarint(hdr[n:], uint64(f.Length))
+	if payload {
+		n += binary.PutUvarint(hdr[n:], uint64(len(f.Payload)))
+	}
+
+	if _, c.err = c.w.Write(hdr[:n]); c.err == nil && payload {
+		_, c.err = c.w.Write(f.Payload)
+	}
+	c.failed.Store(c.err != nil)
+	return c.err
+}
+
+// Flush waits for the queued frames of the sessions, then writes the
+// buffered records to the underlying writer.
+func (c *CaptureWriter) Flush() error {
+	c.qmu.Lock()
+	for c.writing {
+		c.idle.Wait()
+	}
+	c.qmu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.err = c.w.Flush()
+	c.failed.Store(c.err != nil)
+	return c.err
+}
+
+// Dropped returns the number of frames of the sessions dropped because the
+// capture fell behind.
+func (c *CaptureWriter) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// enqueue queues a frame of a session for writeLoop without blocking, the
+// frame is dropped if the queue is full. The write error is returned once
+// the capture failed.
+func (c *CaptureWriter) enqueue(f *CapturedFrame) error {
+	if c.failed.Load() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	}
+
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	if len(c.queue) >= captureBacklog || c.queued+len(f.Payload) > captureBacklogBytes {
+		c.dropped.Add(1)
+		return nil
+	}
+	c.queue = append(c.queue, f)
+	c.queued += len(f.Payload)
+	if !c.writing {
+		c.writing = true
+		go c.writeLoop()
+	}
+	return nil
+}
+
+// writeLoop writes the queued frames in order, it stops once the queue is
+// empty, to be started again by enqueue
+func (c *CaptureWriter) writeLoop() {
+	for {
+		c.qmu.Lock()
+		queue := c.queue
+		c.queue, c.queued = nil, 0
+		if len(queue) == 0 {
+			c.writing = false
+			c.idle.Broadcast()
+			c.qmu.Unlock()
+			return
+		}
+		c.qmu.Unlock()
+
+		for _, f := range queue {
+			_ = c.WriteFrame(f)
+		}
+	}
+}
+
+// CaptureReader reads the frames of a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks the capture file header of r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	var magic [len(captureMagic)]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil || magic != captureMagic {
+		return nil, fmt.Errorf("%w: bad file header", ErrInvalidCapture)
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// ReadFrame returns the next frame, io.EOF at the end of the capture.
+func (c *CaptureReader) ReadFrame() (*CapturedFrame, error) {
+	var hdr [captureHeaderSize]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated record", ErrInvalidCapture)
+		}
+		return nil, err
+	}
+
+	f := &CapturedFrame{
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[1:]))),
+		Session:  binary.LittleEndian.Uint64(hdr[9:]),
+		Version:  hdr[17],
+		Cmd:      hdr[18],
+		StreamID: binary.LittleEndian.Uint32(hdr[19:]),
+	}
+	if hdr[0]&captureInbound != 0 {
+		f.Direction = Inbound
+	}
+	length, err := binary.ReadUvarint(c.r)
+	if err != nil || length > maxCaptureLength {
+		return nil, fmt.Errorf("%w: bad frame length", ErrInvalidCapture)
+	}
+	f.Length = int(length)
+
+	if hdr[0]&capturePayload != 0 {
+		size, err := binary.ReadUvarint(c.r)
+		if err != nil || size > length {
+			return nil, fmt.Errorf("%w: bad payload length", ErrInvalidCapture)
+		}
+		f.Payload = make([]byte, size)
+		if _, err := io.ReadFull(c.r, f.Payload); err != nil {
+			return nil, fmt.Errorf("%w: truncated payload", ErrInvalidCapture)
+		}
+	}
+	return f, nil
+}
+
+// Replay writes the frames of the capture accepted by match, with their
+// payloads, as raw frames to w, e.g. a net.Pipe end of a Session under test.
+// Frames must have been captured with payloads. It returns the number of
+// frames written.
+func (c *CaptureReader) Replay(w io.Writer, match func(f *CapturedFrame) bool) (int, error) {
+	var n int
+	var buf []byte
+	for {
+		f, err := c.ReadFrame()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if match != nil && !match(f) {
+			continue
+		}
+		if len(f.Payload) != f.Length {
+			return n, ErrCaptureNoPayload
+		}
+
+		buf = appendHeader(buf[:0], f.Version, f.Cmd, f.Length, f.StreamID)
+		buf = append(buf, f.Payload...)
+		if _, err := w.Write(buf); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// SetCapture records the frames of the session to c from now on, nil stops
+// capturing. Config.Capture is used by default.
+func (s *Session) SetCapture(c *CaptureWriter) {
+	s.capture.Store(c)
+}
+
+// captureSent records a frame written to the connection, the payload is
+// copied since its buffer is reused once written
+func (s *Session) captureSent(c *CaptureWriter, f *Frame) {
+	var payload []byte
+	if c.Payloads() {
+		payload = slices.Clone(f.data)
+	}
+	s.captureFrame(c, &CapturedFrame{
+		Time:      time.Now(),
+		Session:   s.id,
+		Direction: Outbound,
+		Version:   f.ver,
+		Cmd:       f.cmd,
+		StreamID:  f.sid,
+		Length:    len(f.data),
+		Payload:   payload,
+	})
+}
+
+// captureReceived records a frame header read from the connection, the
+// payload is read ahead for readFull when payloads are captured
+func (s *Session) captureReceived(c *CaptureWriter, hdr rawHeader) error {
+	f := &CapturedFrame{
+		Time:      time.Now(),
+		Session:   s.id,
+		Direction: Inbound,
+		Version:   hdr.Version(),
+		Cmd:       hdr.Cmd(),
+		StreamID:  hdr.StreamID(),
+		Length:    int(hdr.Length()),
+	}
+	if c.Payloads() && f.Length > 0 {
+		payload := make([]byte, f.Length)
+		if _, err := s.readFull(payload); err != nil {
+			return err
+		}
+		f.Payload = payload
+		s.peeked = payload
+	}
+	s.captureFrame(c, f)
+	return nil
+}
+
+// captureFrame queues the record, a failing capture is stopped
+func (s *Session) captureFrame(c *CaptureWriter, f *CapturedFrame) {
+	if f.Payload == nil {
+		f.Payload = []byte{}
+	}
+	if err := c.enqueue(f); err != nil {
+		s.capture.CompareAndSwap(c, nil)
+		s.log(slog.LevelWarn, "smux capture stopped", "error", err)
+	}
+}
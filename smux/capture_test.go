@@ -0,0 +1,148 @@
+package smux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCapture(t *testing.T) {
+	config := DefaultConfig()
+	config.Version = 2
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+	var file bytes.Buffer
+	capture, err := NewCaptureWriter(&file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetCapture(capture)
+
+	local, err := cli.OpenStreamContext(context.Background(), Metadata{MetaService: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	remote, err := srv.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = local.Write([]byte("hello"))
+	_ = local.Close()
+	if data, err := io.ReadAll(remote); err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	_ = remote.Close()
+	_ = srv.Close()
+	if err := capture.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the frames of the client are received in order
+	reader, err := NewCaptureReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []string
+	for {
+		f, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if f.Session != srv.ID() || f.Length != len(f.Payload) {
+			t.Fatalf("unexpected record %v", f)
+		}
+		if f.Direction == Inbound && f.StreamID == local.ID() {
+			cmds = append(cmds, f.Command())
+			if f.Cmd == cmdPSH && string(f.Payload) != "hello" {
+				t.Fatalf("captured payload %q", f.Payload)
+			}
+		}
+	}
+	// the client closes first, the server which may still write is stopped
+	if got := strings.Join(cmds, " "); got != "SYN PSH STOP FIN" {
+		t.Fatalf("captured %s", got)
+	}
+
+	// replaying the capture gives the same stream to a new session
+	a, b := net.Pipe()
+	defer a.Close()
+	replayed := Server(b, config)
+	defer replayed.Close()
+	go func() { _, _ = io.Copy(io.Discard, a) }()
+	go func() {
+		reader, _ := NewCaptureReader(bytes.NewReader(file.Bytes()))
+		_, _ = reader.Replay(a, func(f *CapturedFrame) bool { return f.Direction == Inbound })
+	}()
+
+	_ = replayed.SetDeadline(time.Now().Add(5 * time.Second))
+	stream, err := replayed.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Metadata().Get(MetaService) != "echo" {
+		t.Fatalf("replayed metadata %v", stream.Metadata())
+	}
+	if data, err := io.ReadAll(stream); err != nil || string(data) != "hello" {
+		t.Fatalf("replayed %q, %v", data, err)
+	}
+}
+
+func TestCaptureWithoutPayload(t *testing.T) {
+	var file bytes.Buffer
+	capture, _ := NewCaptureWriter(&file, false)
+	_ = capture.WriteFrame(&CapturedFrame{Time: time.Now(), Cmd: cmdPSH, StreamID: 3, Length: 5, Payload: []byte("hello")})
+	_ = capture.Flush()
+
+	reader, err := NewCaptureReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Replay(io.Discard, nil); err != ErrCaptureNoPayload {
+		t.Fatalf("expected ErrCaptureNoPayload, got %v", err)
+	}
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("garbage!"))); err == nil {
+		t.Fatal("invalid header accepted")
+	}
+}
+
+// stalledWriter blocks writes until released
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return len(b), nil
+}
+
+func TestCaptureFallsBehind(t *testing.T) {
+	w := &stalledWriter{release: make(chan struct{})}
+	capture, err := NewCaptureWriter(w, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := newSessionPair(t, nil)
+	cli.SetCapture(capture)
+	local, remote := openPair(t, cli, srv)
+	go func() { _, _ = io.Copy(io.Discard, remote) }()
+
+	// the session is not held back by the capture
+	_ = local.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Write(make([]byte, 2*captureBacklogBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if capture.Dropped() == 0 {
+		t.Fatal("no frame dropped")
+	}
+	close(w.release)
+	if err := capture.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package smux
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// size of the random salt each side sends before its first record
+	sizeOfSalt = 32
+	// size of the key derived for each direction
+	sizeOfKey = 32
+	// size of the record length prefix
+	sizeOfRecordLength = 4
+)
+
+// ErrAuthFailed is reported as a protocol error when a frame fails
+// authentication, which means it was tampered with or a wrong secret is used.
+var ErrAuthFailed = errors.New("frame authentication failed")
+
+// NewAESGCM is the default Config.AEAD, a 32 bytes key selects AES-256-GCM.
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveAEAD derives the key of one direction from the shared secret and the
+// random salts of both peers, the sender's first. Each side picks a new salt
+// per session, thus a recorded session does not authenticate when replayed
+// to another receiver. The sender's role is bound into the key, thus frames
+// reflected back to their sender never authenticate.
+func deriveAEAD(config *Config, senderSalt, receiverSalt []byte, client bool) (cipher.AEAD, error) {
+	info := "smux server to client"
+	if client {
+		info = "smux client to server"
+	}
+	salt := make([]byte, 0, len(senderSalt)+len(receiverSalt))
+	salt = append(append(salt, senderSalt...), receiverSalt...)
+	key, err := hkdf.Key(sha256.New, config.Secret, salt, info, sizeOfKey)
+	if err != nil {
+		return nil, err
+	}
+
+	newAEAD := config.AEAD
+	if newAEAD == nil {
+		newAEAD = NewAESGCM
+	}
+	return newAEAD(key)
+}
+
+// incrNonce treats the nonce as a little-endian counter
+func incrNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// frameSealer protects outgoing frames, each frame is sealed as one record:
+// |4B length| ciphertext with tag |, the length is authenticated as additional data.
+// Both peers send their random salt first, the records are sealed once the
+// peer's salt is known.
+type frameSealer struct {
+	config *Config
+	client bool
+	salt   []byte // own salt, sent ahead of the records
+	aead   cipher.AEAD
+	nonce  []byte
+}
+
+func newFrameSealer(config *Config, client bool) (*frameSealer, error) {
+	salt := make([]byte, sizeOfSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &frameSealer{config: config, client: client, salt: salt}, nil
+}
+
+// setPeerSalt derives the key from the salt read by the frameOpener
+func (fs *frameSealer) setPeerSalt(peerSalt []byte) error {
+	aead, err := deriveAEAD(fs.config, fs.salt, peerSalt, fs.client)
+	if err != nil {
+		return err
+	}
+	fs.aead = aead
+	fs.nonce = make([]byte, aead.NonceSize())
+	return nil
+}
+
+// seal appends p sealed as a single record to dst
+func (fs *frameSealer) seal(dst, p []byte) []byte {
+	off := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(p)+fs.aead.Overhead()))
+	dst = fs.aead.Seal(dst, fs.nonce, p, dst[off:])
+	incrNonce(fs.nonce)
+	return dst
+}
+
+// frameOpener authenticates and decrypts records written by the peer's frameSealer.
+type frameOpener struct {
+	config  *Config
+	client  bool               // role of the peer
+	maxSize int                // max length of a record
+	salt    []byte             // own salt, the peer's one is read first
+	onSalt  func([]byte) error // called with the peer's salt
+	aead    cipher.AEAD
+	nonce   []byte
+	buf     []byte
+	plain   []byte // decrypted but not yet consumed
+}
+
+func newFrameOpener(config *Config, peerClient bool, maxPlain int, salt []byte, onSalt func([]byte) error) *frameOpener {
+	return &frameOpener{config: config, client: peerClient, maxSize: maxPlain + 64, salt: salt, onSalt: onSalt}
+}
+
+// readFull fills b with plaintext, reading more records as needed
+func (fo *frameOpener) readFull(r io.Reader, b []byte) (int, error) {
+	var n int
+	for n < len(b) {
+		if len(fo.plain) == 0 {
+			if err := fo.next(r); err != nil {
+				return n, err
+			}
+		}
+		m := copy(b[n:], fo.plain)
+		fo.plain = fo.plain[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (fo *frameOpener) next(r io.Reader) error {
+	if fo.aead == nil {
+		salt := make([]byte, sizeOfSalt)
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return err
+		}
+		aead, err := deriveAEAD(fo.config, salt, fo.salt, fo.client)
+		if err != nil {
+			return err
+		}
+		if fo.onSalt != nil {
+			if err := fo.onSalt(salt); err != nil {
+				return err
+			}
+		}
+		fo.aead = aead
+		fo.nonce = make([]byte, aead.NonceSize())
+	}
+
+	var length [sizeOfRecordLength]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	size := int(binary.LittleEndian.Uint32(length[:]))
+	if size < fo.aead.Overhead() || size > fo.maxSize {
+		return fmt.Errorf("%w: record size %d", ErrInvalidProtocol, size)
+	}
+
+	if cap(fo.buf) < size {
+		fo.buf = make([]byte, size)
+	}
+	buf := fo.buf[:size]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	plain, err := fo.aead.Open(buf[:0], fo.nonce, buf, length[:])
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProtocol, ErrAuthFailed)
+	}
+	incrNonce(fo.nonce)
+	fo.plain = plain
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package smux
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCompressionThreshold is the size below which frames are sent uncompressed
+const defaultCompressionThreshold = 256
+
+// errInflateTooLarge is returned when a frame does not fit once decompressed
+var errInflateTooLarge = fmt.Errorf("%w: decompressed frame too large", ErrInvalidProtocol)
+
+// defaultCompressionDict primes the compressor with strings frequently seen
+// in JSON messages and logs, the most frequent ones come last.
+var defaultCompressionDict = []byte(`` +
+	`application/json; charset=utf-8 HTTP/1.1 http:// https:// ` +
+	`"created_at":"updated_at":"timestamp":"message":"status":"result":"config":` +
+	`"level":"debug""level":"info""level":"warn""level":"error""msg":"time":` +
+	`"code":"data":"name":"type":"value":"host":"addr":"port":"path":"size":` +
+	`true,false,null,"id":`)
+
+// CompressionStats counts data frames compressed in one direction.
+type CompressionStats struct {
+	Frames     uint64 `json:"frames"`     // frames compressed
+	Raw        uint64 `json:"raw"`        // data bytes before compression
+	Compressed uint64 `json:"compressed"` // data bytes after compression
+}
+
+// Ratio returns compressed size divided by raw size, 0 if nothing has been compressed.
+func (c CompressionStats) Ratio() float64 {
+	if c.Raw == 0 {
+		return 0
+	}
+	return float64(c.Compressed) / float64(c.Raw)
+}
+
+// compressionCounters holds the compression counters of one direction
+type compressionCounters struct {
+	frames     atomic.Uint64
+	raw        atomic.Uint64
+	compressed atomic.Uint64
+}
+
+func (c *compressionCounters) count(raw, compressed int) {
+	c.frames.Add(1)
+	c.raw.Add(uint64(raw))
+	c.compressed.Add(uint64(compressed))
+}
+
+func (c *compressionCounters) stats() CompressionStats {
+	return CompressionStats{Frames: c.frames.Load(), Raw: c.raw.Load(), Compressed: c.compressed.Load()}
+}
+
+// codec compresses each frame independently with a dictionary shared by both
+// peers, so frames may be compressed or not at will, and in any goroutine.
+type codec struct {
+	dict      []byte
+	threshold int
+	writers   sync.Pool // *flate.Writer
+	reader    io.ReadCloser
+	src       bytes.Reader
+}
+
+func newCodec(config *Config) *codec {
+	c := &codec{dict: config.CompressionDict, threshold: config.CompressionThreshold}
+	if c.dict == nil {
+		c.dict = defaultCompressionDict
+	}
+	if c.threshold <= 0 {
+		c.threshold = defaultCompressionThreshold
+	}
+	return c
+}
+
+// compress returns the compressed data, or nil if it is not worth it
+func (c *codec) compress(data []byte) []byte {
+	if len(data) < c.threshold {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)))
+	fw, _ := c.writers.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriterDict(buf, flate.BestSpeed, c.dict)
+	} else {
+		fw.Reset(buf)
+	}
+	defer c.writers.Put(fw)
+
+	if _, err := fw.Write(data); err != nil {
+		return nil
+	}
+	if err := fw.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// decompress inflates data into dst, failing if it does not fit,
+// it's only called by recvLoop.
+func (c *codec) decompress(dst, data []byte) (int, error) {
+	c.src.Reset(data)
+	if c.reader == nil {
+		c.reader = flate.NewReaderDict(&c.src, c.dict)
+	} else if err := c.reader.(flate.Resetter).Reset(&c.src, c.dict); err != nil {
+		return 0, err
+	}
+
+	var n int
+	var probe [1]byte
+	for {
+		buf := dst[n:]
+		if len(buf) == 0 {
+			// dst is full, make sure nothing is left
+			buf = probe[:]
+		}
+		m, err := c.reader.Read(buf)
+		if len(dst) == n && m != 0 {
+			return 0, errInflateTooLarge
+		}
+		n += m
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrInvalidProtocol, err)
+		}
+	}
+}
+
+// inflate decompresses the payload of ZPSH into a buffer from the allocator,
+// the payload is recycled.
+func (s *Session) inflate(data []byte) ([]byte, error) {
+	if s.inflateBuf == nil {
+		s.inflateBuf = make([]byte, maxSmallFrameSize)
+	}
+	var buf []byte
+	n, err := s.codec.decompress(s.inflateBuf, data)
+	if err == nil && n > 0 {
+		buf = defaultAllocator.Get(n)
+		copy(buf, s.inflateBuf[:n])
+	}
+	// large frames are inflated right into buffers of the allocator, growing
+	// as needed, so that the session doesn't keep a large buffer
+	for size := len(s.inflateBuf); err == errInflateTooLarge && s.version() >= largeFrameVersion && size < maxLargeFrameSize; {
+		size = min(4*size, maxLargeFrameSize)
+		buf = defaultAllocator.Get(size)
+		if n, err = s.codec.decompress(buf, data); err == nil {
+			buf = buf[:n]
+		} else {
+			defaultAllocator.Put(buf)
+			buf = nil
+		}
+	}
+	size := len(data)
+	defaultAllocator.Put(data)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: empty compressed frame", ErrInvalidProtocol)
+	}
+
+	s.counters.compressionReceived.count(n, size)
+	return buf, nil
+}
+
+// compressionEnabled checks if data frames are compressed on this session
+func (s *Session) compressionEnabled() bool {
+	return s.config.Compression && s.peerSupports(FeatureCompression)
+}
+
+// SetCompression controls whether data frames of the stream are compressed,
+// it's enabled by default when the session compresses, and is worth turning
+// off for streams carrying already compressed data.
+func (s *Stream) SetCompression(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&s.noCompression, 0)
+	} else {
+		atomic.StoreInt32(&s.noCompression, 1)
+	}
+}
+
+// compressFrame turns a PSH frame into ZPSH if it's worth it
+func (s *Stream) compressFrame(f Frame) Frame {
+	if f.cmd != cmdPSH || atomic.LoadInt32(&s.noCompression) != 0 || !s.sess.compressionEnabled() {
+		return f
+	}
+	if data := s.sess.codec.compress(f.data); data != nil {
+		s.sess.counters.compressionSent.count(len(f.data), len(data))
+		f.cmd = cmdZPSH
+		f.data = data
+	}
+	return f
+}
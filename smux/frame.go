@@ -15,12 +15,38 @@ const ( // cmds
 	// protocol version 2 extra commands
 	// notify bytes consumed by remote peer-end
 	cmdUPD
+
+	// extension commands
+	cmdSTOP   // stop sending, the peer-end has closed the read side
+	cmdGOAWAY // session draining, no more streams should be opened
+	cmdPING   // round-trip probe
+	cmdPONG   // answer to cmdPING
+	cmdRST    // stream reset with an error code
+	cmdZPSH   // compressed data push
+	cmdMSG    // message datagram, outside of streams
+	cmdMUPD   // message credits granted by the receiver
 )
 
 const (
 	// data size of cmdUPD, format:
 	// |4B data consumed(ACK)| 4B window size(WINDOW) |
 	szCmdUPD = 8
+
+	// data size of cmdGOAWAY, format:
+	// |4B last accepted stream id|
+	szCmdGOAWAY = 4
+
+	// data size of cmdPING and cmdPONG, format:
+	// |8B opaque id|
+	szCmdPING = 8
+
+	// minimum data size of cmdRST, format:
+	// |4B error code| reason |
+	szCmdRST = 4
+
+	// data size of cmdMUPD, format:
+	// |4B messages consumed|
+	szCmdMUPD = 4
 )
 
 const (
@@ -34,8 +60,44 @@ const (
 	sizeOfLength = 2
 	sizeOfSid    = 4
 	headerSize   = sizeOfVer + sizeOfCmd + sizeOfSid + sizeOfLength
+
+	// protocol version 3 appends the high bits of the length:
+	// |1B ver|1B cmd|2B length low|4B sid|2B length high|
+	sizeOfLengthHigh = 2
+	largeHeaderSize  = headerSize + sizeOfLengthHigh
 )
 
+const (
+	// first protocol version with 32-bit frame lengths
+	largeFrameVersion = 3
+
+	// max frame size of protocol versions 1 and 2
+	maxSmallFrameSize = 65535
+
+	// max frame size of protocol version 3, frames are received in
+	// one buffer, the 32-bit length is not used in full
+	maxLargeFrameSize = 16 << 20
+)
+
+// headerLen returns the size of frame headers in the protocol version
+func headerLen(version byte) int {
+	if version >= largeFrameVersion {
+		return largeHeaderSize
+	}
+	return headerSize
+}
+
+// appendHeader appends the header of a frame carrying length bytes
+func appendHeader(buf []byte, version, cmd byte, length int, sid uint32) []byte {
+	buf = append(buf, version, cmd)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(length))
+	buf = binary.LittleEndian.AppendUint32(buf, sid)
+	if version >= largeFrameVersion {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(length>>16))
+	}
+	return buf
+}
+
 // Frame defines a packet from or to be multiplexed into a single connection
 type Frame struct {
 	ver  byte
@@ -48,7 +110,9 @@ func newFrame(version byte, cmd byte, sid uint32) Frame {
 	return Frame{ver: version, cmd: cmd, sid: sid}
 }
 
-type rawHeader [headerSize]byte
+// rawHeader holds a received header, the high bits of the length are zero
+// before protocol version 3
+type rawHeader [largeHeaderSize]byte
 
 func (h rawHeader) Version() byte {
 	return h[0]
@@ -58,14 +122,31 @@ func (h rawHeader) Cmd() byte {
 	return h[1]
 }
 
-func (h rawHeader) Length() uint16 {
-	return binary.LittleEndian.Uint16(h[2:])
+func (h rawHeader) Length() uint32 {
+	return uint32(binary.LittleEndian.Uint16(h[2:])) | uint32(binary.LittleEndian.Uint16(h[headerSize:]))<<16
 }
 
 func (h rawHeader) StreamID() uint32 {
 	return binary.LittleEndian.Uint32(h[4:])
 }
 
+// validLength checks the data size of the commands carrying a fixed payload
+func (h rawHeader) validLength() bool {
+	switch h.Cmd() {
+	case cmdNOP, cmdFIN, cmdSTOP:
+		return h.Length() == 0
+	case cmdUPD:
+		return h.Length() == szCmdUPD
+	case cmdGOAWAY:
+		return h.Length() == szCmdGOAWAY
+	case cmdPING, cmdPONG:
+		return h.Length() == szCmdPING
+	case cmdMUPD:
+		return h.Length() == szCmdMUPD
+	}
+	return h.Length() <= maxLargeFrameSize
+}
+
 func (h rawHeader) String() string {
 	return fmt.Sprintf("Version:%d Cmd:%d StreamID:%d Length:%d",
 		h.Version(), h.Cmd(), h.StreamID(), h.Length())
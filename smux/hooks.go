@@ -0,0 +1,114 @@
+package smux
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+// sessionIDs numbers the sessions of the process
+var sessionIDs uint64
+
+// closeReason holds the first failure of a session
+type closeReason struct {
+	err error
+}
+
+// ID returns the identifier of the session, unique within the process,
+// it's recorded by the logger along with the stream IDs.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// CloseReason returns why the session died: a read or write error on the
+// connection, a protocol error, or ErrKeepAliveTimeout. It returns nil while
+// the session is healthy, and if it has been closed locally without failure.
+func (s *Session) CloseReason() error {
+	if reason, ok := s.closeReason.Load().(closeReason); ok {
+		return reason.err
+	}
+	return nil
+}
+
+// setCloseReason records the first failure of the session
+func (s *Session) setCloseReason(err error) {
+	if s.closeReason.CompareAndSwap(nil, closeReason{err}) {
+		s.log(slog.LevelWarn, "smux session failed", "error", err)
+	}
+}
+
+// log records an event if Config.Logger is set
+func (s *Session) log(level slog.Level, msg string, args ...any) {
+	if s.logger != nil {
+		s.logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// streamOpened reports a stream opened locally or accepted from the peer
+func (s *Session) streamOpened(stream *Stream, local bool) {
+	if s.logger != nil {
+		args := []any{"stream", stream.id, "local", local}
+		if service := stream.meta.Get(MetaService); service != "" {
+			args = append(args, "service", service)
+		}
+		s.log(slog.LevelInfo, "smux stream opened", args...)
+	}
+	if s.config.OnStreamOpen != nil {
+		s.config.OnStreamOpen(stream)
+	}
+}
+
+// streamGone reports a closed stream once
+func (s *Session) streamGone(stream *Stream, reason error) {
+	if !atomic.CompareAndSwapInt32(&stream.gone, 0, 1) {
+		return
+	}
+	if s.logger != nil {
+		args := []any{"stream", stream.id, "in", stream.counters.bytesIn.Load(), "out", stream.counters.bytesOut.Load()}
+		if reason != nil {
+			args = append(args, "reason", reason)
+		}
+		s.log(slog.LevelInfo, "smux stream closed", args...)
+	}
+	if s.config.OnStreamClose != nil {
+		s.config.OnStreamClose(stream, reason)
+	}
+}
+
+// sessionGone reports once the session closed or failed, and its remaining
+// streams. A failed session leaves the memory budget here too, it may never
+// be closed.
+func (s *Session) sessionGone() {
+	if s.budget != nil {
+		s.budget.leave(s)
+	}
+	s.goneOnce.Do(s.reportGone)
+}
+
+func (s *Session) reportGone() {
+	s.streamLock.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.streamLock.Unlock()
+
+	reason := s.CloseReason()
+	streamReason := reason
+	if streamReason == nil {
+		streamReason = io.ErrClosedPipe
+	}
+	for _, stream := range streams {
+		s.streamGone(stream, streamReason)
+	}
+
+	if reason != nil {
+		s.log(slog.LevelInfo, "smux session closed", "reason", reason)
+	} else {
+		s.log(slog.LevelInfo, "smux session closed")
+	}
+	if s.config.OnSessionClose != nil {
+		s.config.OnSessionClose(s, reason)
+	}
+}
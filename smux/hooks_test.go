@@ -0,0 +1,130 @@
+package smux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	var logs bytes.Buffer
+	var logMu sync.Mutex
+	config := DefaultConfig()
+	config.Logger = slog.New(slog.NewTextHandler(&lockedWriter{w: &logs, mu: &logMu}, nil))
+	config.OnStreamOpen = func(*Stream) { record("open") }
+	config.OnStreamClose = func(_ *Stream, reason error) {
+		if reason == nil {
+			record("close")
+		} else {
+			record("close: " + reason.Error())
+		}
+	}
+	gone := make(chan struct{}, 2)
+	config.OnSessionClose = func(_ *Session, reason error) {
+		record("session")
+		gone <- struct{}{}
+	}
+
+	cli, srv := newSessionPair(t, config)
+	local, _ := openPair(t, cli, srv)
+	_ = local.Close()
+	_ = cli.Close()
+	<-gone
+	// the server fails reading, it's reported without Close
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session not reported closed")
+	}
+	_ = srv.Close()
+
+	mu.Lock()
+	got := strings.Join(events, ", ")
+	mu.Unlock()
+	want := "open, open, close, session, close: EOF, session"
+	if got != want {
+		t.Fatalf("events: %s, want %s", got, want)
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	for _, msg := range []string{"smux session opened", "smux stream opened", "smux stream closed", "smux session closed", "session=" + strconv.FormatUint(cli.ID(), 10)} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("%q not logged in:\n%s", msg, logs.String())
+		}
+	}
+}
+
+func TestSessionHookBeforeAccept(t *testing.T) {
+	var opened atomic.Int32
+	config := DefaultConfig()
+	config.OnStreamOpen = func(*Stream) {
+		time.Sleep(10 * time.Millisecond)
+		opened.Add(1)
+	}
+	cli, srv := newSessionPair(t, config)
+
+	for i := 0; i < 3; i++ {
+		if _, err := cli.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := srv.AcceptStream(); err != nil {
+			t.Fatal(err)
+		}
+		// one for the client, one for the server
+		if n := opened.Load(); n != int32(2*(i+1)) {
+			t.Fatalf("stream accepted before OnStreamOpen, %d calls", n)
+		}
+	}
+}
+
+func TestSessionCloseReason(t *testing.T) {
+	a, b := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, b) }() // the peer never answers
+	defer b.Close()
+
+	reasons := make(chan error, 1)
+	config := DefaultConfig()
+	config.KeepAliveDisabled = false
+	config.KeepAliveInterval = 50 * time.Millisecond
+	config.KeepAliveTimeout = 150 * time.Millisecond
+	config.OnSessionClose = func(_ *Session, reason error) { reasons <- reason }
+	sess := Client(a, config)
+
+	select {
+	case reason := <-reasons:
+		if !errors.Is(reason, ErrKeepAliveTimeout) || sess.CloseReason() != reason {
+			t.Fatalf("expected ErrKeepAliveTimeout, got %v", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed by keepalive")
+	}
+}
+
+// lockedWriter serializes writes of concurrent loggers
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,101 @@
+package smux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minJanitorInterval = 10 * time.Millisecond
+	maxJanitorInterval = time.Second
+)
+
+// SetIdleTimeout closes the stream once there have been no reads or writes
+// for the timeout, the local Read and Write fail with ErrStreamIdle, and the
+// peer is told with a RST carrying CodeIdleTimeout. A timeout <= 0 disables
+// it, Config.StreamIdleTimeout is used by default.
+func (s *Stream) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout.Store(int64(max(timeout, 0)))
+	s.touch()
+	if timeout > 0 {
+		s.sess.startJanitor()
+		s.sess.notifyJanitor()
+	}
+}
+
+// IdleTimeout returns the idle timeout of the stream, 0 if none.
+func (s *Stream) IdleTimeout() time.Duration {
+	return time.Duration(s.idleTimeout.Load())
+}
+
+// touch records a read or write of the stream, data arriving from the peer
+// doesn't keep the stream from idling
+func (s *Stream) touch() {
+	now := time.Now().UnixNano()
+	s.lastIO.Store(now)
+	s.counters.lastActivity.Store(now)
+}
+
+// startJanitor starts closing idle streams
+func (s *Session) startJanitor() {
+	s.janitorOnce.Do(func() {
+		go s.janitor()
+	})
+}
+
+// notifyJanitor wakes up the janitor to take a new timeout into account
+func (s *Session) notifyJanitor() {
+	select {
+	case s.chJanitor <- struct{}{}:
+	default:
+	}
+}
+
+// janitor wakes up when the next stream may expire, and closes the idle ones
+func (s *Session) janitor() {
+	timer := time.NewTimer(maxJanitorInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.chJanitor:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-s.die:
+			return
+		}
+		timer.Reset(s.closeIdleStreams())
+	}
+}
+
+// closeIdleStreams resets the expired streams, and returns when to check again
+func (s *Session) closeIdleStreams() time.Duration {
+	now := time.Now()
+	next := maxJanitorInterval
+	var idle []*Stream
+
+	s.streamLock.Lock()
+	for _, stream := range s.streams {
+		timeout := time.Duration(stream.idleTimeout.Load())
+		if timeout <= 0 {
+			continue
+		}
+		left := time.Unix(0, stream.lastIO.Load()).Add(timeout).Sub(now)
+		if left > 0 {
+			next = min(next, left)
+		} else if atomic.CompareAndSwapInt32(&stream.idleExpired, 0, 1) {
+			// reset once, the RST may take a while to be written
+			idle = append(idle, stream)
+		}
+	}
+	s.streamLock.Unlock()
+
+	for _, stream := range idle {
+		go stream.Reset(CodeIdleTimeout, "no reads or writes for "+stream.IdleTimeout().String())
+	}
+	return max(next, minJanitorInterval)
+}
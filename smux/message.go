@@ -0,0 +1,176 @@
+package smux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+const (
+	// messages each side may send before the peer grants more credits
+	initialMessageCredits = 16
+
+	defaultMessageBacklog = 64
+	defaultMaxMessageSize = 65535
+)
+
+// ErrMessageTooLarge is returned when sending a message larger than
+// Config.MaxMessageSize, or exchanging one larger than the limit of a
+// MessageConn.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// SendMessage sends a whole message to the peer, which receives it with
+// ReceiveMessage. Messages travel outside of streams, in order, and are
+// limited to Config.MaxMessageSize. It blocks while the peer has not
+// consumed the messages sent before, as many as its Config.MessageBacklog
+// may be pending. The messages waiting for ReceiveMessage count towards
+// Config.MaxReceiveBuffer and Config.MemoryBudget. Once the message is
+// queued, it's sent even if ctx is done meanwhile, and nil is returned.
+func (s *Session) SendMessage(ctx context.Context, msg []byte) error {
+	if err := s.waitNegotiated(nil, ctx.Done(), ctx.Err); err != nil {
+		return err
+	}
+	if !s.peerSupports(FeatureMessage) {
+		return ErrNotSupported
+	}
+	if len(msg) > s.maxMessageSize() {
+		return ErrMessageTooLarge
+	}
+
+	s.msgSendLock.Lock()
+	defer s.msgSendLock.Unlock()
+	for atomic.LoadInt32(&s.msgCredits) <= 0 {
+		select {
+		case <-s.chMsgCredits:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.chSocketWriteError:
+			return s.socketWriteError.Load().(error)
+		case <-s.die:
+			return io.ErrClosedPipe
+		}
+	}
+
+	frame := newFrame(s.version(), cmdMSG, 0)
+	frame.data = msg
+	// messages share the bandwidth with the streams as if they were one
+	req := writeRequest{class: CLSDATA, frame: frame}
+	atomic.AddInt32(&s.msgCredits, -1)
+	req, err := s.queueRequest(req, nil, ctx.Done(), ctx.Err)
+	if err != nil {
+		atomic.AddInt32(&s.msgCredits, 1)
+		return err
+	}
+	// the message is sent once queued, even if ctx is done meanwhile
+	_, err = s.waitRequest(req, nil, ctx.Done(), func() error { return nil })
+	return err
+}
+
+// ReceiveMessage returns the next message sent by the peer with SendMessage.
+func (s *Session) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-s.chMessages:
+		s.messageReceived(msg)
+		return msg, nil
+	default:
+	}
+
+	select {
+	case msg := <-s.chMessages:
+		s.messageReceived(msg)
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.chSocketReadError:
+		return nil, s.socketReadError.Load().(error)
+	case <-s.chProtoError:
+		return nil, s.protoError.Load().(error)
+	case <-s.die:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// maxMessageSize returns the size limit of messages, a message is one frame
+func (s *Session) maxMessageSize() int {
+	limit := defaultMaxMessageSize
+	if s.config.MaxMessageSize > 0 {
+		limit = s.config.MaxMessageSize
+	}
+	if s.version() < largeFrameVersion {
+		limit = min(limit, maxSmallFrameSize)
+	}
+	return limit
+}
+
+// messageBacklog returns how many received messages may wait for ReceiveMessage
+func (s *Session) messageBacklog() int {
+	if s.config.MessageBacklog <= 0 {
+		return defaultMessageBacklog
+	}
+	return max(s.config.MessageBacklog, initialMessageCredits)
+}
+
+// readMessage reads a message of size bytes for recvLoop and queues it,
+// the size is checked before anything is allocated, a larger message is
+// skipped. The queued messages are accounted like the data of the streams.
+func (s *Session) readMessage(size int) error {
+	if atomic.CompareAndSwapInt32(&s.msgGranted, 0, 1) {
+		// the peer speaks messages, grant the rest of the backlog
+		s.messageConsumed(s.messageBacklog() - initialMessageCredits)
+	}
+	if limit := s.maxMessageSize(); size > limit {
+		s.log(slog.LevelWarn, "smux message dropped", "size", size, "limit", limit)
+		s.messageConsumed(1)
+		return s.discard(size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := s.readFull(msg); err != nil {
+		return err
+	}
+	select {
+	case s.chMessages <- msg:
+		s.takeTokens(size)
+		return nil
+	default:
+		return fmt.Errorf("%w: message backlog overflow", ErrInvalidProtocol)
+	}
+}
+
+// messageReceived returns the credit and the tokens of a message
+func (s *Session) messageReceived(msg []byte) {
+	s.messageConsumed(1)
+	s.returnTokens(len(msg))
+}
+
+// messageConsumed returns credits to the peer, in batches
+func (s *Session) messageConsumed(n int) {
+	if n <= 0 {
+		return
+	}
+	pending := atomic.AddInt32(&s.msgConsumed, int32(n))
+	if int(pending) < max(s.messageBacklog()/4, 1) || !atomic.CompareAndSwapInt32(&s.msgConsumed, pending, 0) {
+		return
+	}
+
+	frame := newFrame(s.version(), cmdMUPD, 0)
+	frame.data = binary.LittleEndian.AppendUint32(nil, uint32(pending))
+	go func() {
+		if _, err := s.writeFrame(frame); err != nil && !s.IsClosed() {
+			atomic.AddInt32(&s.msgConsumed, pending)
+		}
+	}()
+}
+
+// onMessageCredits wakes up SendMessage with the credits granted by the peer
+func (s *Session) onMessageCredits(n uint32) {
+	atomic.AddInt32(&s.msgCredits, int32(n))
+	select {
+	case s.chMsgCredits <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,161 @@
+package smux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionMessage(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, msg := range []string{"heartbeat", "", "config changed"} {
+		if err := cli.SendMessage(ctx, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"heartbeat", "", "config changed"} {
+		msg, err := srv.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != want {
+			t.Fatalf("received %q, want %q", msg, want)
+		}
+	}
+	if err := cli.SendMessage(ctx, make([]byte, 70000)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+	if n := srv.NumStreams(); n != 0 {
+		t.Fatalf("messages opened %d streams", n)
+	}
+}
+
+func TestSessionMessageBuffered(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the messages waiting count towards MaxReceiveBuffer
+	if err := cli.SendMessage(ctx, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	limit := int32(srv.config.MaxReceiveBuffer)
+	for atomic.LoadInt32(&srv.bucket) != limit-1000 {
+		if ctx.Err() != nil {
+			t.Fatalf("bucket %d while a message waits", atomic.LoadInt32(&srv.bucket))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := srv.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&srv.bucket); n != limit {
+		t.Fatalf("bucket %d after the message is received", n)
+	}
+}
+
+func TestSessionMessageBacklog(t *testing.T) {
+	config := DefaultConfig()
+	config.MessageBacklog = initialMessageCredits
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < initialMessageCredits; i++ {
+		if err := cli.SendMessage(ctx, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the backlog of the server is full
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if err := cli.SendMessage(short, []byte("blocked")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the sender to block, got %v", err)
+	}
+
+	sent := make(chan error, 1)
+	go func() { sent <- cli.SendMessage(ctx, []byte("unblocked")) }()
+	for i := 0; i < initialMessageCredits; i++ {
+		if msg, err := srv.ReceiveMessage(ctx); err != nil || msg[0] != byte(i) {
+			t.Fatalf("received %v, %v", msg, err)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := srv.ReceiveMessage(ctx); err != nil || string(msg) != "unblocked" {
+		t.Fatalf("received %q, %v", msg, err)
+	}
+}
+
+func TestSessionMessageDropped(t *testing.T) {
+	c1, c2 := net.Pipe()
+	config := DefaultConfig()
+	config.Negotiate = true
+	a := Client(c1, config)
+	defer a.Close()
+	config = DefaultConfig()
+	config.Negotiate = true
+	config.MaxMessageSize = 8
+	b := Server(c2, config)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_ = a.SendMessage(ctx, []byte("larger than the limit"))
+	_ = a.SendMessage(ctx, []byte("small"))
+	if msg, err := b.ReceiveMessage(ctx); err != nil || string(msg) != "small" {
+		t.Fatalf("received %q, %v", msg, err)
+	}
+}
+
+func TestSessionMessageCancelQueued(t *testing.T) {
+	a, b := net.Pipe()
+	conn := &holdingConn{Conn: a}
+	config := DefaultConfig()
+	config.Negotiate = true
+	cli := Client(conn, config)
+	defer cli.Close()
+	srv := Server(b, config)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cli.SendMessage(ctx, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the rest of the backlog is granted after the first message
+	for atomic.LoadInt32(&cli.msgCredits) != defaultMessageBacklog-1 {
+		if ctx.Err() != nil {
+			t.Fatal("backlog not granted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// queued, then given up on while the connection is held
+	hold := make(chan struct{})
+	conn.hold.Store(&hold)
+	credits := atomic.LoadInt32(&cli.msgCredits)
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := cli.SendMessage(short, []byte("second")); err != nil {
+		t.Fatalf("queued message reported %v", err)
+	}
+	if n := atomic.LoadInt32(&cli.msgCredits); n != credits-1 {
+		t.Fatalf("credits %d, want %d", n, credits-1)
+	}
+	conn.hold.Store(nil)
+	close(hold)
+	if msg, err := srv.ReceiveMessage(ctx); err != nil || string(msg) != "second" {
+		t.Fatalf("received %q, %v", msg, err)
+	}
+}
@@ -0,0 +1,67 @@
+package smux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+)
+
+// ErrMetadataTooLarge is returned when the encoded metadata does not fit in a frame.
+var ErrMetadataTooLarge = errors.New("stream metadata too large")
+
+// Metadata is a small header travelling with the SYN of a stream, such as
+// a service name, a target address or a trace id.
+// It is encoded as a sequence of |uvarint length| key | uvarint length| value |.
+type Metadata map[string]string
+
+// Get returns the value associated with key, or "" if none.
+func (m Metadata) Get(key string) string {
+	return m[key]
+}
+
+// encode serializes the metadata
+func (m Metadata) encode() []byte {
+	var buf []byte
+	for k, v := range m {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+// decodeMetadata parses the metadata carried by a SYN
+func decodeMetadata(buf []byte) (Metadata, error) {
+	meta := make(Metadata)
+	next := func() (string, error) {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || size > uint64(len(buf)-n) {
+			return "", fmt.Errorf("%w: malformed stream metadata", ErrInvalidProtocol)
+		}
+		str := string(buf[n : n+int(size)])
+		buf = buf[n+int(size):]
+		return str, nil
+	}
+
+	for len(buf) > 0 {
+		key, err := next()
+		if err != nil {
+			return nil, err
+		}
+		val, err := next()
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = val
+	}
+
+	return meta, nil
+}
+
+// Metadata returns a copy of the metadata the stream was opened with,
+// nil if none was given.
+func (s *Stream) Metadata() Metadata {
+	return maps.Clone(s.meta)
+}
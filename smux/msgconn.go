@@ -0,0 +1,279 @@
+package smux
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// size of the length prefix of the messages of a MessageConn
+	msgLenSize = 4
+
+	defaultMaxConnMessageSize = 4 << 20
+
+	// largest message, bounded by the length prefix and by int on 32-bit
+	// platforms
+	maxConnMessageSize = math.MaxUint32 & math.MaxInt
+
+	// messages up to this size are written along with their length in
+	// one buffer, larger ones are not copied
+	msgCopyThreshold = 32 << 10
+)
+
+// Codec encodes the values exchanged with MessageConn.WriteValue and
+// MessageConn.ReadValue.
+//
+// Unmarshal must copy the data if it wishes to retain it after returning,
+// the buffer is reused for the next message.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSONCodec encodes values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+
+	// BinaryCodec encodes values implementing encoding.BinaryMarshaler and
+	// encoding.BinaryUnmarshaler, and raw []byte.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	case []byte:
+		return v, nil
+	}
+	return nil, fmt.Errorf("smux: %T does not implement encoding.BinaryMarshaler", v)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case encoding.BinaryUnmarshaler:
+		return v.UnmarshalBinary(data)
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	}
+	return fmt.Errorf("smux: %T does not implement encoding.BinaryUnmarshaler", v)
+}
+
+// MessageConn keeps the boundaries of the messages written to a Stream, or
+// any other io.ReadWriter. Each message is prefixed with its length, 4 bytes
+// little-endian, and may span as many frames as needed.
+//
+// A message is written or read as a whole, reads and writes are safe for
+// concurrent use. A failure in the middle of a message leaves the
+// connection out of step with the peer, every later call in the same
+// direction fails with the same error.
+type MessageConn struct {
+	rw      io.ReadWriter
+	maxSize int
+	codec   Codec
+
+	rlock   sync.Mutex
+	rhdr    [msgLenSize]byte
+	rhdrLen int    // bytes of rhdr read so far
+	rsize   int    // size of the next message once its length is read, -1 before
+	rbuf    []byte // reused by ReadValue
+	rerr    error
+
+	wlock sync.Mutex
+	werr  error
+}
+
+// NewMessageConn creates a MessageConn over rw, usually a *Stream. Messages
+// larger than maxSize, 4MB if not positive, are refused both ways, codec
+// serves WriteValue and ReadValue, JSONCodec if nil.
+func NewMessageConn(rw io.ReadWriter, maxSize int, codec Codec) *MessageConn {
+	if maxSize <= 0 {
+		maxSize = defaultMaxConnMessageSize
+	}
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return &MessageConn{
+		rw:      rw,
+		maxSize: min(maxSize, maxConnMessageSize),
+		codec:   codec,
+		rsize:   -1,
+	}
+}
+
+// WriteMessage writes msg as one message.
+func (c *MessageConn) WriteMessage(msg []byte) error {
+	if len(msg) > c.maxSize {
+		return ErrMessageTooLarge
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.werr != nil {
+		return c.werr
+	}
+
+	var written int
+	var err error
+	if len(msg) <= msgCopyThreshold {
+		buf := defaultAllocator.Get(msgLenSize + len(msg))
+		binary.LittleEndian.PutUint32(buf, uint32(len(msg)))
+		copy(buf[msgLenSize:], msg)
+		written, err = c.rw.Write(buf)
+		_ = defaultAllocator.Put(buf)
+	} else {
+		var hdr [msgLenSize]byte
+		binary.LittleEndian.PutUint32(hdr[:], uint32(len(msg)))
+		if written, err = c.rw.Write(hdr[:]); err == nil {
+			var n int
+			n, err = c.rw.Write(msg)
+			written += n
+		}
+	}
+	if err != nil && written > 0 {
+		c.werr = fmt.Errorf("message partially written: %w", err)
+	}
+	return err
+}
+
+// WriteValue encodes v with the codec and writes it as one message.
+func (c *MessageConn) WriteValue(v any) error {
+	msg, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(msg)
+}
+
+// NextSize waits for the next message and returns its size, so that a
+// buffer large enough can be given to ReadMessageInto.
+func (c *MessageConn) NextSize() (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	return c.next()
+}
+
+// ReadMessage reads the next message into a new buffer.
+func (c *MessageConn) ReadMessage() ([]byte, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	size, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if err := c.readPayload(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ReadMessageInto reads the next message right into buf, without copying
+// it through an intermediate buffer, and returns its size. It fails with
+// io.ErrShortBuffer if the message does not fit, the message is then kept
+// for the next read.
+func (c *MessageConn) ReadMessageInto(buf []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	size, err := c.next()
+	if err != nil {
+		return 0, err
+	}
+	if size > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	if err := c.readPayload(buf[:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// ReadValue reads the next message and decodes it into v with the codec.
+// The message is decoded before the next read may reuse its buffer.
+func (c *MessageConn) ReadValue(v any) error {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	size, err := c.next()
+	if err != nil {
+		return err
+	}
+	if cap(c.rbuf) < size {
+		c.rbuf = make([]byte, size)
+	}
+	msg := c.rbuf[:size]
+	if size > msgCopyThreshold {
+		c.rbuf = nil // don't pin a large buffer
+	}
+	if err := c.readPayload(msg); err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(msg, v)
+}
+
+// next reads the length of the next message, a read interrupted before
+// the length is complete, e.g. by a deadline, resumes on the next call
+func (c *MessageConn) next() (int, error) {
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+	if c.rsize >= 0 {
+		return c.rsize, nil
+	}
+
+	for c.rhdrLen < msgLenSize {
+		n, err := c.rw.Read(c.rhdr[c.rhdrLen:])
+		c.rhdrLen += n
+		if c.rhdrLen == msgLenSize {
+			break
+		}
+		if err == io.EOF && c.rhdrLen > 0 {
+			c.rerr = io.ErrUnexpectedEOF
+			return 0, c.rerr
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	size := binary.LittleEndian.Uint32(c.rhdr[:])
+	if uint64(size) > uint64(c.maxSize) {
+		c.rerr = fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, size)
+		return 0, c.rerr
+	}
+	c.rsize = int(size)
+	return c.rsize, nil
+}
+
+// readPayload reads the message whose length was read by next
+func (c *MessageConn) readPayload(buf []byte) error {
+	if _, err := io.ReadFull(c.rw, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.rerr = fmt.Errorf("message partially read: %w", err)
+		return c.rerr
+	}
+	c.rhdrLen = 0
+	c.rsize = -1
+	return nil
+}
+
+// Close closes the underlying io.ReadWriter if it's an io.Closer.
+func (c *MessageConn) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package smux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageConn(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxFrameSize = 4096
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+	w := NewMessageConn(local, 1<<20, nil)
+	r := NewMessageConn(remote, 1<<20, nil)
+
+	// messages span many frames and may be empty
+	large := bytes.Repeat([]byte("0123456789"), 10000)
+	msgs := [][]byte{[]byte("hello"), {}, large}
+	written := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := w.WriteMessage(msg); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range msgs {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, want) {
+			t.Fatalf("read %d bytes, want %d", len(msg), len(want))
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessage(make([]byte, 1<<20+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestMessageConnReadInto(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+	w := NewMessageConn(local, 0, nil)
+	r := NewMessageConn(remote, 0, nil)
+	go func() { _ = w.WriteMessage([]byte("zero-copy")) }()
+
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := r.ReadMessageInto(buf); err != io.ErrShortBuffer {
+		t.Fatalf("expected io.ErrShortBuffer, got %v", err)
+	}
+	size, err := r.NextSize()
+	if err != nil || size != 9 {
+		t.Fatalf("next size %d, %v", size, err)
+	}
+	buf = make([]byte, size)
+	if n, err := r.ReadMessageInto(buf); err != nil || string(buf[:n]) != "zero-copy" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestMessageConnTooLarge(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+	w := NewMessageConn(local, 0, nil)
+	r := NewMessageConn(remote, 16, nil)
+	go func() { _ = w.WriteMessage(make([]byte, 17)) }()
+
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+	// the connection is out of step for good
+	if _, err := r.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge again, got %v", err)
+	}
+
+	// bounded by the length prefix
+	if c := NewMessageConn(local, math.MaxInt, nil); c.maxSize != maxConnMessageSize {
+		t.Fatalf("max size %d", c.maxSize)
+	}
+}
+
+func TestMessageConnCodecs(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type event struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	w := NewMessageConn(local, 0, JSONCodec)
+	r := NewMessageConn(remote, 0, JSONCodec)
+	written := make(chan error, 1)
+	go func() { written <- w.WriteValue(event{Name: "login", Count: 3}) }()
+	var ev event
+	if err := r.ReadValue(&ev); err != nil || ev != (event{Name: "login", Count: 3}) {
+		t.Fatalf("read %+v, %v", ev, err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	w = NewMessageConn(local, 0, BinaryCodec)
+	r = NewMessageConn(remote, 0, BinaryCodec)
+	now := time.Now()
+	go func() { _ = w.WriteValue(now) }()
+	var got time.Time
+	if err := r.ReadValue(&got); err != nil || !got.Equal(now) {
+		t.Fatalf("read %v, %v", got, err)
+	}
+	if err := w.WriteValue(42); err == nil {
+		t.Fatal("expected an error encoding an int")
+	}
+}
+
+func TestMessageConnConcurrentReadValue(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	w := NewMessageConn(local, 0, nil)
+	r := NewMessageConn(remote, 0, nil)
+
+	const count = 200
+	go func() {
+		for i := 0; i < count; i++ {
+			_ = w.WriteValue(strings.Repeat("x", i))
+		}
+	}()
+
+	// the buffer of a message is not reused while it's decoded
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			for j := 0; j < count/2; j++ {
+				var s string
+				if err := r.ReadValue(&s); err != nil {
+					errs <- err
+					return
+				}
+				if strings.Trim(s, "x") != "" {
+					errs <- fmt.Errorf("decoded %q", s)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
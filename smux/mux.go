@@ -5,18 +5,40 @@
 package smux
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math"
 	"net"
+	"slices"
 	"time"
 )
 
 // Config is used to tune the Smux session
 type Config struct {
-	// SMUX Protocol version, support 1,2
+	// SMUX Protocol version, support 1,2,3. Version 2 adds flow control,
+	// version 3 extends it with 32-bit frame lengths for MaxFrameSize
+	// past 65535, it's only understood by peers of this package.
 	Version int
 
+	// Negotiate enables the HELLO exchange, both peers advertise Versions
+	// and optional features, then settle on the highest common version.
+	// Version is used until then and must be spoken by every peer, since
+	// peers without negotiation ignore the HELLO and keep on using it.
+	// Without negotiation the peer may be a stock smux, the extensions of
+	// this package are left unused but KeepAlivePing and Compression, the
+	// peer must then be configured with them too.
+	Negotiate bool
+
+	// Versions is the protocol versions advertised in HELLO, versions 1,
+	// 2 and Version are advertised if empty, 3 must be asked for.
+	Versions []int
+
+	// NegotiateTimeout is how long to wait for the peer's HELLO
+	// before falling back to Version, defaults to 5 seconds.
+	NegotiateTimeout time.Duration
+
 	// Disabled keepalive
 	KeepAliveDisabled bool
 
@@ -27,8 +49,13 @@ type Config struct {
 	// will be closed if no data has arrived
 	KeepAliveTimeout time.Duration
 
+	// KeepAlivePing sends PING instead of NOP to keep alive, which measures
+	// the RTT and detects a dead peer even if the receive bucket is exhausted
+	KeepAlivePing bool
+
 	// MaxFrameSize is used to control the maximum
-	// frame size to sent to the remote
+	// frame size to sent to the remote, up to 65535 bytes,
+	// or 16MB if protocol version 3 may be used, see Version.
 	MaxFrameSize int
 
 	// MaxReceiveBuffer is used to control the maximum
@@ -38,8 +65,106 @@ type Config struct {
 	// MaxStreamBuffer is used to control the maximum
 	// number of data per stream
 	MaxStreamBuffer int
-	ReadTimeout     time.Duration
-	Passwd          []byte
+
+	// SendRate and ReceiveRate limit the bandwidth of the session in bytes
+	// per second, 0 means unlimited, see Session.SetRateLimit
+	SendRate    int
+	ReceiveRate int
+
+	// StreamSendRate and StreamReceiveRate limit the bandwidth of each
+	// stream in bytes per second, 0 means unlimited, see Stream.SetRateLimit
+	StreamSendRate    int
+	StreamReceiveRate int
+
+	// MaxStreams limits the number of concurrent streams, local and remote,
+	// the SYNs in excess are refused with CodeTooManyStreams, 0 means unlimited
+	MaxStreams int
+
+	// AcceptBacklog is the number of streams waiting for AcceptStream,
+	// the SYNs in excess are refused with CodeTooManyStreams, defaults to 1024
+	AcceptBacklog int
+
+	// StreamIdleTimeout closes streams without reads or writes for this
+	// period, Read and Write fail with ErrStreamIdle, 0 means never,
+	// see Stream.SetIdleTimeout
+	StreamIdleTimeout time.Duration
+
+	// StreamWeight is the initial weight of streams when competing for
+	// sending, defaults to DefaultStreamWeight, see Stream.SetWeight
+	StreamWeight int
+
+	ReadTimeout time.Duration
+
+	// Passwd obfuscates the traffic with a repeating-key XOR, it's ignored
+	// when Secret is set.
+	//
+	// Deprecated: it provides neither confidentiality nor integrity, use Secret.
+	Passwd []byte
+
+	// Secret enables authenticated encryption of all frames when not empty,
+	// per-direction keys are derived from it and the random salts of both
+	// peers with HKDF-SHA256, thus both peers must share the same secret.
+	// Tampered frames are reported as protocol errors.
+	Secret []byte
+
+	// Compression compresses data frames with DEFLATE when the peer
+	// agrees, each frame is compressed on its own against CompressionDict.
+	Compression bool
+
+	// CompressionThreshold is the size below which data frames are sent
+	// uncompressed, defaults to 256 bytes.
+	CompressionThreshold int
+
+	// CompressionDict is the preset dictionary shared by both peers,
+	// a built-in dictionary tuned for JSON and logs is used if nil.
+	CompressionDict []byte
+
+	// AEAD creates the cipher protecting frames from a derived 32 bytes key,
+	// defaults to NewAESGCM. It accepts chacha20poly1305.New as well.
+	AEAD func(key []byte) (cipher.AEAD, error)
+
+	// Logger records the lifecycle of the session and its streams
+	// with their IDs, nothing is logged if nil.
+	Logger *slog.Logger
+
+	// OnStreamOpen is called when a stream is opened or accepted, and
+	// OnStreamClose when it is closed, reset, or its session closes or
+	// fails, reason is nil after Close. OnSessionClose is called once when
+	// the session is closed or fails, reason is the failure which killed it,
+	// see Session.CloseReason. The hooks must not block, accepted streams
+	// are handed to AcceptStream after OnStreamOpen returns.
+	OnStreamOpen   func(stream *Stream)
+	OnStreamClose  func(stream *Stream, reason error)
+	OnSessionClose func(sess *Session, reason error)
+
+	// ResumeBuffer bounds the bytes kept for replay until the peer
+	// acknowledges them on resumable sessions, writing blocks when it is
+	// full, defaults to 4MB. It bounds the bytes received ahead of the
+	// reader as well, thus the peer's must not be larger, it fails the
+	// session otherwise. See DialResumable, DialBonded and Resumer.
+	ResumeBuffer int
+
+	// ResumeTimeout is how long a resumable session waits for a new
+	// connection before closing, defaults to 30 seconds.
+	ResumeTimeout time.Duration
+
+	// MaxMessageSize limits the messages sent with Session.SendMessage,
+	// larger messages received are dropped. It defaults to 65535 bytes,
+	// which is also the limit before protocol version 3.
+	MaxMessageSize int
+
+	// MessageBacklog is how many received messages may wait for
+	// Session.ReceiveMessage, the peer stops sending until they are
+	// consumed, defaults to 64.
+	MessageBacklog int
+
+	// MemoryBudget caps the receive buffers of all the sessions sharing
+	// it, each one still bounded by MaxReceiveBuffer, see MemoryBudget.
+	MemoryBudget *MemoryBudget
+
+	// Capture records the frames sent and received by the session, they are
+	// dropped if it falls behind, see CaptureWriter and Session.SetCapture.
+	Capture *CaptureWriter
 }
 
 // DefaultConfig is used to return a default configuration
@@ -55,11 +180,21 @@ func DefaultConfig() *Config {
 	}
 }
 
+// largeFramesEnabled checks if the session may speak protocol version 3
+func largeFramesEnabled(config *Config) bool {
+	return config.Version >= largeFrameVersion || (config.Negotiate && slices.Contains(config.Versions, largeFrameVersion))
+}
+
 // VerifyConfig is used to verify the sanity of configuration
 func VerifyConfig(config *Config) error {
-	if !(config.Version == 1 || config.Version == 2) {
+	if !(config.Version == 1 || config.Version == 2 || config.Version == 3) {
 		return errors.New("unsupported protocol version")
 	}
+	for _, v := range config.Versions {
+		if v < 1 || v > 8 || supportedVersions&(1<<(v-1)) == 0 {
+			return fmt.Errorf("unsupported protocol version %d", v)
+		}
+	}
 	if !config.KeepAliveDisabled {
 		if config.KeepAliveInterval == 0 {
 			return errors.New("keep-alive interval must be positive")
@@ -71,8 +206,11 @@ func VerifyConfig(config *Config) error {
 	if config.MaxFrameSize <= 0 {
 		return errors.New("max frame size must be positive")
 	}
-	if config.MaxFrameSize > 65535 {
-		return errors.New("max frame size must not be larger than 65535")
+	if config.MaxFrameSize > maxSmallFrameSize && !largeFramesEnabled(config) {
+		return errors.New("max frame size must not be larger than 65535 before protocol version 3")
+	}
+	if config.MaxFrameSize > maxLargeFrameSize {
+		return fmt.Errorf("max frame size must not be larger than %d", maxLargeFrameSize)
 	}
 	if config.MaxReceiveBuffer <= 0 {
 		return errors.New("max receive buffer must be positive")
@@ -86,28 +224,60 @@ func VerifyConfig(config *Config) error {
 	if config.MaxStreamBuffer > math.MaxInt32 {
 		return errors.New("max stream buffer cannot be larger than 2147483647")
 	}
+	if config.SendRate < 0 || config.ReceiveRate < 0 || config.StreamSendRate < 0 || config.StreamReceiveRate < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if config.MaxStreams < 0 || config.AcceptBacklog < 0 {
+		return errors.New("max streams and accept backlog must not be negative")
+	}
+	if config.StreamWeight < 0 || config.StreamWeight > MaxStreamWeight {
+		return errors.New("stream weight must be in [1, 256]")
+	}
+	if len(config.Passwd) != 0 && len(config.Secret) != 0 {
+		return errors.New("passwd and secret cannot be used together")
+	}
+	if len(config.Secret) != 0 && config.AEAD != nil {
+		if _, err := config.AEAD(make([]byte, 32)); err != nil {
+			return fmt.Errorf("aead: %w", err)
+		}
+	}
+	if config.CompressionThreshold < 0 {
+		return errors.New("compression threshold must not be negative")
+	}
+	if config.ReadTimeout < 0 || config.NegotiateTimeout < 0 || config.ResumeTimeout < 0 || config.StreamIdleTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if config.MaxMessageSize < 0 || config.MessageBacklog < 0 {
+		return errors.New("max message size and message backlog must not be negative")
+	}
+	if config.MaxMessageSize > maxSmallFrameSize && !largeFramesEnabled(config) {
+		return errors.New("max message size must not be larger than 65535 before protocol version 3")
+	}
+	if config.MaxMessageSize > maxLargeFrameSize {
+		return fmt.Errorf("max message size must not be larger than %d", maxLargeFrameSize)
+	}
+	if config.ResumeBuffer < 0 {
+		return errors.New("resume buffer must not be negative")
+	}
 	return nil
 }
 
 // Server is used to initialize a new server-side connection.
+//
+// Deprecated: config is not verified, use NewServer with WithConfig.
 func Server(conn net.Conn, config *Config) *Session {
 	if config == nil {
 		config = DefaultConfig()
 	}
-	//if err := VerifyConfig(config); err != nil {
-	//	return nil, err
-	//}
 	return newSession(config, conn, false)
 }
 
 // Client is used to initialize a new client-side connection.
+//
+// Deprecated: config is not verified, use NewClient with WithConfig.
 func Client(conn net.Conn, config *Config) *Session {
 	if config == nil {
 		config = DefaultConfig()
 	}
-
-	//if err := VerifyConfig(config); err != nil {
-	//	return nil, err
-	//}
 	return newSession(config, conn, true)
 }
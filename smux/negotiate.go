@@ -0,0 +1,222 @@
+package smux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// HELLO is carried by a NOP frame whose stream id field holds:
+// |1B magic| 1B versions bitmap| 2B features bitmap|,
+// peers without negotiation support ignore it like any other NOP.
+const (
+	helloMagic = 0xA5
+
+	defaultNegotiateTimeout = 5 * time.Second
+)
+
+// supportedVersions is the bitmap of protocol versions this package speaks,
+// bit n-1 is set for version n.
+const supportedVersions = 1<<0 | 1<<1 | 1<<2
+
+// defaultVersions is the bitmap advertised if Config.Versions is empty, the
+// large frames of version 3 are only used on the sessions asking for them.
+const defaultVersions = 1<<0 | 1<<1
+
+// Feature is a bitmap of optional protocol features.
+type Feature uint16
+
+const (
+	// FeatureEncryption reports frames are protected with Config.Secret,
+	// it is set automatically.
+	FeatureEncryption Feature = 1 << iota
+
+	// FeaturePing reports PING and PONG are understood.
+	FeaturePing
+
+	// FeatureMetadata reports SYN may carry stream metadata.
+	FeatureMetadata
+
+	// FeatureReset reports RST is understood.
+	FeatureReset
+
+	// FeatureCompression reports data frames may be compressed,
+	// it's offered if Config.Compression is set.
+	FeatureCompression
+
+	// FeatureMessage reports messages are understood, see SendMessage.
+	FeatureMessage
+)
+
+// Has reports whether all features in f2 are present in f.
+func (f Feature) Has(f2 Feature) bool {
+	return f&f2 == f2
+}
+
+// Negotiation is the result of the HELLO exchange.
+type Negotiation struct {
+	Version  int     // protocol version in use
+	Features Feature // features supported by both peers
+	Legacy   bool    // negotiation did not take place, Config.Version is used
+}
+
+func (n Negotiation) String() string {
+	return fmt.Sprintf("Version:%d Features:%#04x Legacy:%t", n.Version, uint16(n.Features), n.Legacy)
+}
+
+// helloFrame builds the HELLO advertising what this side supports
+func (s *Session) helloFrame() Frame {
+	sid := uint32(helloMagic) | uint32(s.offeredVersions())<<8 | uint32(s.offeredFeatures())<<16
+	return newFrame(byte(s.config.Version), cmdNOP, sid)
+}
+
+// isHello checks if a NOP frame carries a HELLO
+func isHello(sid uint32) bool {
+	return sid&0xff == helloMagic
+}
+
+// offeredVersions returns the versions bitmap advertised by this side
+func (s *Session) offeredVersions() byte {
+	if len(s.config.Versions) == 0 {
+		return defaultVersions | 1<<(s.config.Version-1)
+	}
+
+	var bitmap byte
+	for _, v := range s.config.Versions {
+		if v >= 1 && v <= 8 {
+			bitmap |= 1 << (v - 1)
+		}
+	}
+	return bitmap & supportedVersions
+}
+
+// offeredFeatures returns the features bitmap advertised by this side
+func (s *Session) offeredFeatures() Feature {
+	features := FeaturePing | FeatureMetadata | FeatureReset | FeatureMessage
+	if len(s.config.Secret) != 0 {
+		features |= FeatureEncryption
+	}
+	if s.config.Compression {
+		features |= FeatureCompression
+	}
+	return features
+}
+
+// negotiate starts the HELLO exchange, the session settles on the highest
+// common version once the peer's HELLO arrives, or falls back to
+// Config.Version if the peer speaks first without HELLO or stays silent.
+func (s *Session) negotiate() {
+	timeout := s.config.NegotiateTimeout
+	if timeout <= 0 {
+		timeout = defaultNegotiateTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	_, err := s.writeFrameInternal(s.helloFrame(), timer.C, CLSCTRL)
+	close(s.chHelloSent)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			s.settle(Negotiation{Version: s.config.Version, Legacy: true})
+		}
+		return
+	}
+
+	select {
+	case <-timer.C:
+		s.settle(Negotiation{Version: s.config.Version, Legacy: true})
+	case <-s.chNegotiated:
+	case <-s.die:
+	}
+}
+
+// onHello handles the peer's HELLO
+func (s *Session) onHello(sid uint32) error {
+	versions := byte(sid>>8) & s.offeredVersions()
+	if versions == 0 {
+		return fmt.Errorf("%w: no common version", ErrInvalidProtocol)
+	}
+	result := Negotiation{
+		Version:  bits.Len8(versions),
+		Features: Feature(sid>>16) & s.offeredFeatures(),
+	}
+
+	if !s.settle(result) && s.Negotiated().Version != result.Version {
+		// settled by timeout before HELLO arrived
+		return fmt.Errorf("%w: negotiation mismatch", ErrInvalidProtocol)
+	}
+	return nil
+}
+
+// settle stores the negotiation result, only the first call takes effect
+func (s *Session) settle(result Negotiation) bool {
+	var once bool
+	s.negotiateOnce.Do(func() {
+		s.negotiated.Store(result)
+		atomic.StoreInt32(&s.ver, int32(result.Version))
+		close(s.chNegotiated)
+		once = true
+	})
+	return once
+}
+
+// settled checks if the protocol version has been determined
+func (s *Session) settled() bool {
+	select {
+	case <-s.chNegotiated:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitNegotiated blocks until the protocol version has been determined and
+// the own HELLO has been sent, the peer's HELLO may settle the version first,
+// yet the peer must not see frames of the negotiated version before HELLO.
+func (s *Session) waitNegotiated(deadline <-chan time.Time, cancel <-chan struct{}, cause func() error) error {
+	for _, ch := range []chan struct{}{s.chNegotiated, s.chHelloSent} {
+		select {
+		case <-ch:
+		case <-s.die:
+			return io.ErrClosedPipe
+		case <-s.chSocketReadError:
+			return s.socketReadError.Load().(error)
+		case <-s.chProtoError:
+			return s.protoError.Load().(error)
+		case <-deadline:
+			return context.DeadlineExceeded
+		case <-cancel:
+			return cause()
+		}
+	}
+	return nil
+}
+
+// Negotiated returns the result of the HELLO exchange, the zero value is
+// returned while the exchange is in progress. Sessions without
+// Config.Negotiate report Config.Version as a legacy result.
+func (s *Session) Negotiated() Negotiation {
+	result, _ := s.negotiated.Load().(Negotiation)
+	return result
+}
+
+// frameSize returns the max size of data frames sent by the streams,
+// Config.MaxFrameSize is only allowed past 65535 bytes by version 3.
+func (s *Session) frameSize() int {
+	if s.version() < largeFrameVersion {
+		return min(s.config.MaxFrameSize, maxSmallFrameSize)
+	}
+	return s.config.MaxFrameSize
+}
+
+// version returns the protocol version used for outgoing frames,
+// Config.Version until negotiation completes.
+func (s *Session) version() byte {
+	if v := atomic.LoadInt32(&s.ver); v != 0 {
+		return byte(v)
+	}
+	return byte(s.config.Version)
+}
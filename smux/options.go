@@ -0,0 +1,234 @@
+package smux
+
+import (
+	"crypto/cipher"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+// Option tunes the Config of a session created by NewServer or NewClient.
+type Option func(*Config)
+
+// NewServer is used to initialize a new server-side session, options are
+// applied to DefaultConfig, the resulting configuration is verified.
+func NewServer(conn net.Conn, opts ...Option) (*Session, error) {
+	config, err := buildConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(config, conn, false), nil
+}
+
+// NewClient is used to initialize a new client-side session, options are
+// applied to DefaultConfig, the resulting configuration is verified.
+func NewClient(conn net.Conn, opts ...Option) (*Session, error) {
+	config, err := buildConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(config, conn, true), nil
+}
+
+func buildConfig(opts []Option) (*Config, error) {
+	config := DefaultConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := VerifyConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// WithConfig starts from a copy of config instead of DefaultConfig,
+// the options after it apply on top. A nil config is ignored.
+func WithConfig(config *Config) Option {
+	return func(c *Config) {
+		if config == nil {
+			return
+		}
+		*c = *config
+		c.Versions = slices.Clone(config.Versions)
+		c.Passwd = slices.Clone(config.Passwd)
+		c.Secret = slices.Clone(config.Secret)
+		c.CompressionDict = slices.Clone(config.CompressionDict)
+	}
+}
+
+// WithVersion sets Config.Version.
+func WithVersion(version int) Option {
+	return func(c *Config) { c.Version = version }
+}
+
+// WithNegotiation enables the HELLO exchange advertising versions,
+// see Config.Versions if none is given. See Config.Negotiate.
+func WithNegotiation(versions ...int) Option {
+	return func(c *Config) {
+		c.Negotiate = true
+		c.Versions = slices.Clone(versions)
+	}
+}
+
+// WithNegotiateTimeout sets Config.NegotiateTimeout.
+func WithNegotiateTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.NegotiateTimeout = timeout }
+}
+
+// WithKeepAlive enables keepalive with the interval and timeout.
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.KeepAliveDisabled = false
+		c.KeepAliveInterval = interval
+		c.KeepAliveTimeout = timeout
+	}
+}
+
+// WithoutKeepAlive disables keepalive.
+func WithoutKeepAlive() Option {
+	return func(c *Config) { c.KeepAliveDisabled = true }
+}
+
+// WithKeepAlivePing sets Config.KeepAlivePing.
+func WithKeepAlivePing(enabled bool) Option {
+	return func(c *Config) { c.KeepAlivePing = enabled }
+}
+
+// WithMaxFrameSize sets Config.MaxFrameSize.
+func WithMaxFrameSize(size int) Option {
+	return func(c *Config) { c.MaxFrameSize = size }
+}
+
+// WithMaxReceiveBuffer sets Config.MaxReceiveBuffer.
+func WithMaxReceiveBuffer(size int) Option {
+	return func(c *Config) { c.MaxReceiveBuffer = size }
+}
+
+// WithMaxStreamBuffer sets Config.MaxStreamBuffer.
+func WithMaxStreamBuffer(size int) Option {
+	return func(c *Config) { c.MaxStreamBuffer = size }
+}
+
+// WithRateLimit sets Config.SendRate and Config.ReceiveRate.
+func WithRateLimit(send, receive int) Option {
+	return func(c *Config) {
+		c.SendRate = send
+		c.ReceiveRate = receive
+	}
+}
+
+// WithStreamRateLimit sets Config.StreamSendRate and Config.StreamReceiveRate.
+func WithStreamRateLimit(send, receive int) Option {
+	return func(c *Config) {
+		c.StreamSendRate = send
+		c.StreamReceiveRate = receive
+	}
+}
+
+// WithMaxStreams sets Config.MaxStreams.
+func WithMaxStreams(n int) Option {
+	return func(c *Config) { c.MaxStreams = n }
+}
+
+// WithAcceptBacklog sets Config.AcceptBacklog.
+func WithAcceptBacklog(n int) Option {
+	return func(c *Config) { c.AcceptBacklog = n }
+}
+
+// WithStreamIdleTimeout sets Config.StreamIdleTimeout.
+func WithStreamIdleTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.StreamIdleTimeout = timeout }
+}
+
+// WithStreamWeight sets Config.StreamWeight.
+func WithStreamWeight(weight int) Option {
+	return func(c *Config) { c.StreamWeight = weight }
+}
+
+// WithReadTimeout sets Config.ReadTimeout.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.ReadTimeout = timeout }
+}
+
+// WithPasswd sets Config.Passwd.
+//
+// Deprecated: use WithSecret.
+func WithPasswd(passwd []byte) Option {
+	return func(c *Config) { c.Passwd = slices.Clone(passwd) }
+}
+
+// WithSecret sets Config.Secret.
+func WithSecret(secret []byte) Option {
+	return func(c *Config) { c.Secret = slices.Clone(secret) }
+}
+
+// WithAEAD sets Config.AEAD.
+func WithAEAD(aead func(key []byte) (cipher.AEAD, error)) Option {
+	return func(c *Config) { c.AEAD = aead }
+}
+
+// WithCompression sets Config.Compression.
+func WithCompression(enabled bool) Option {
+	return func(c *Config) { c.Compression = enabled }
+}
+
+// WithCompressionThreshold sets Config.CompressionThreshold.
+func WithCompressionThreshold(threshold int) Option {
+	return func(c *Config) { c.CompressionThreshold = threshold }
+}
+
+// WithCompressionDict sets Config.CompressionDict.
+func WithCompressionDict(dict []byte) Option {
+	return func(c *Config) { c.CompressionDict = slices.Clone(dict) }
+}
+
+// WithLogger sets Config.Logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithOnStreamOpen sets Config.OnStreamOpen.
+func WithOnStreamOpen(hook func(stream *Stream)) Option {
+	return func(c *Config) { c.OnStreamOpen = hook }
+}
+
+// WithOnStreamClose sets Config.OnStreamClose.
+func WithOnStreamClose(hook func(stream *Stream, reason error)) Option {
+	return func(c *Config) { c.OnStreamClose = hook }
+}
+
+// WithOnSessionClose sets Config.OnSessionClose.
+func WithOnSessionClose(hook func(sess *Session, reason error)) Option {
+	return func(c *Config) { c.OnSessionClose = hook }
+}
+
+// WithMaxMessageSize sets Config.MaxMessageSize.
+func WithMaxMessageSize(size int) Option {
+	return func(c *Config) { c.MaxMessageSize = size }
+}
+
+// WithMessageBacklog sets Config.MessageBacklog.
+func WithMessageBacklog(n int) Option {
+	return func(c *Config) { c.MessageBacklog = n }
+}
+
+// WithMemoryBudget sets Config.MemoryBudget.
+func WithMemoryBudget(b *MemoryBudget) Option {
+	return func(c *Config) { c.MemoryBudget = b }
+}
+
+// WithCapture sets Config.Capture.
+func WithCapture(c *CaptureWriter) Option {
+	return func(cfg *Config) { cfg.Capture = c }
+}
+
+// WithResumeBuffer sets Config.ResumeBuffer.
+func WithResumeBuffer(size int) Option {
+	return func(c *Config) { c.ResumeBuffer = size }
+}
+
+// WithResumeTimeout sets Config.ResumeTimeout.
+func WithResumeTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.ResumeTimeout = timeout }
+}
@@ -0,0 +1,68 @@
+package smux
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewClientOptions(t *testing.T) {
+	a, b := net.Pipe()
+	cli, err := NewClient(a, WithVersion(2), WithMaxFrameSize(16384), WithKeepAlive(time.Second, 3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	srv, err := NewServer(b, WithConfig(cli.config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if cli.config.Version != 2 || cli.config.MaxFrameSize != 16384 || cli.config.KeepAliveDisabled {
+		t.Fatalf("options not applied: %+v", cli.config)
+	}
+	if srv.config == cli.config || !reflect.DeepEqual(srv.config, cli.config) {
+		t.Fatalf("server config %+v is not a copy of %+v", srv.config, cli.config)
+	}
+	openPair(t, cli, srv)
+}
+
+func TestWithConfig(t *testing.T) {
+	config, err := buildConfig([]Option{WithConfig(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, DefaultConfig()) {
+		t.Fatalf("nil config not ignored: %+v", config)
+	}
+
+	src := DefaultConfig()
+	src.Secret = []byte("secret")
+	src.CompressionDict = []byte("dict")
+	if config, err = buildConfig([]Option{WithConfig(src)}); err != nil {
+		t.Fatal(err)
+	}
+	src.Secret[0], src.CompressionDict[0] = 'X', 'X'
+	if string(config.Secret) != "secret" || string(config.CompressionDict) != "dict" {
+		t.Fatalf("slices shared with the source config: %q %q", config.Secret, config.CompressionDict)
+	}
+}
+
+func TestNewClientInvalid(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"version":        {WithVersion(9)},
+		"frame size":     {WithMaxFrameSize(0)},
+		"stream buffer":  {WithMaxReceiveBuffer(1024), WithMaxStreamBuffer(2048)},
+		"keepalive":      {WithKeepAlive(time.Second, time.Millisecond)},
+		"passwd, secret": {WithPasswd([]byte("a")), WithSecret([]byte("b"))},
+		"rate limit":     {WithRateLimit(-1, 0)},
+	} {
+		a, _ := net.Pipe()
+		if sess, err := NewClient(a, opts...); err == nil {
+			_ = sess.Close()
+			t.Errorf("%s: invalid config accepted", name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package smux
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Ping sends a PING carrying an opaque id and waits for the matching PONG,
+// it returns the round-trip time, which is also folded into the smoothed
+// RTT reported by RTT.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	if err := s.waitNegotiated(nil, ctx.Done(), ctx.Err); err != nil {
+		return 0, err
+	}
+	if !s.peerSupports(FeaturePing) {
+		return 0, ErrNotSupported
+	}
+
+	id := s.pingID.Add(1)
+	chPong := make(chan struct{})
+	s.pingLock.Lock()
+	s.pings[id] = chPong
+	s.pingLock.Unlock()
+	defer func() {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+	}()
+
+	frame := newFrame(s.version(), cmdPING, 0)
+	frame.data = make([]byte, szCmdPING)
+	binary.LittleEndian.PutUint64(frame.data, id)
+	start := time.Now()
+	if _, err := s.writeFrameContext(ctx, frame); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-chPong:
+		rtt := time.Since(start)
+		s.updateRTT(rtt)
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-s.chSocketReadError:
+		return 0, s.socketReadError.Load().(error)
+	case <-s.chProtoError:
+		return 0, s.protoError.Load().(error)
+	case <-s.die:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// RTT returns the smoothed round-trip time measured by Ping,
+// zero if no ping has completed yet.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(s.srtt.Load())
+}
+
+// updateRTT folds a sample into the smoothed RTT, srtt = 7/8 srtt + 1/8 rtt
+func (s *Session) updateRTT(rtt time.Duration) {
+	for {
+		old := s.srtt.Load()
+		srtt := int64(rtt)
+		if old != 0 {
+			srtt = old + (int64(rtt)-old)/8
+		}
+		if s.srtt.CompareAndSwap(old, srtt) {
+			return
+		}
+	}
+}
+
+// onPing answers a PING without blocking recvLoop, the PONG is dropped if
+// too many answers are pending, the peer's Ping times out then
+func (s *Session) onPing(data []byte) {
+	frame := newFrame(s.version(), cmdPONG, 0)
+	frame.data = data
+	if !s.sendControl(frame) {
+		s.log(slog.LevelDebug, "smux pong dropped", "reason", "control queue full")
+	}
+}
+
+// onPong wakes up the Ping waiting for it
+func (s *Session) onPong(data []byte) {
+	id := binary.LittleEndian.Uint64(data)
+	s.pingLock.Lock()
+	if chPong, ok := s.pings[id]; ok {
+		close(chPong)
+		delete(s.pings, id)
+	}
+	s.pingLock.Unlock()
+}
+
+// keepalivePing probes the peer with a PING and allows recvLoop to read one
+// frame even if the bucket is exhausted, so a live peer always proves itself.
+func (s *Session) keepalivePing() {
+	atomic.StoreInt32(&s.probe, 1)
+	s.notifyBucket()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.KeepAliveTimeout)
+	defer cancel()
+	_, _ = s.Ping(ctx)
+}
+
+// peerSupports checks if the peer supports the feature. Without negotiation
+// the peer may be a stock smux, only the features explicitly enabled in
+// Config are assumed, the peer must be configured alike.
+func (s *Session) peerSupports(feature Feature) bool {
+	result := s.Negotiated()
+	if result.Legacy {
+		return s.legacyFeatures().Has(feature)
+	}
+	return result.Features.Has(feature)
+}
+
+// legacyFeatures returns the features used without negotiation
+func (s *Session) legacyFeatures() Feature {
+	var features Feature
+	if s.config.KeepAlivePing {
+		features |= FeaturePing
+	}
+	if s.config.Compression {
+		features |= FeatureCompression
+	}
+	return features
+}
+
+// peerExtended checks if the peer negotiated, thus understands the control
+// frames of this package such as STOP and GOAWAY
+func (s *Session) peerExtended() bool {
+	return !s.Negotiated().Legacy
+}
@@ -0,0 +1,180 @@
+package smux
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket counting bytes. Tokens are reserved ahead
+// of time, the bucket going negative, so the waiters are served in the
+// order they came in, each one waiting for the debt before it to be repaid.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    int     // bytes per second, 0 for unlimited
+	tokens  float64 // negative when reserved in advance
+	last    time.Time
+	changed chan struct{} // closed when the rate changes
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		tokens:  float64(rateBurst(rate)),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// rateBurst returns the bytes a rate limiter lets through at once, a tenth
+// of a second worth of them, larger frames wait for their debt
+func rateBurst(rate int) int {
+	return max(rate/10, 1)
+}
+
+// setRate changes the rate, the waiters reserve again at the new rate
+func (l *rateLimiter) setRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if burst := float64(rateBurst(rate)); l.tokens > burst || rate <= 0 {
+		l.tokens = burst
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *rateLimiter) getRate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// refill adds the tokens accumulated since last time, l.mu must be held
+func (l *rateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		elapsed := now.Sub(l.last).Seconds()
+		l.tokens = min(l.tokens+elapsed*float64(l.rate), float64(rateBurst(l.rate)))
+	}
+	l.last = now
+}
+
+// reserve takes n tokens, it returns how long to wait for them
+// and a channel closed if the rate changes meanwhile.
+func (l *rateLimiter) reserve(n int) (time.Duration, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, nil
+	}
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second)), l.changed
+}
+
+// release gives back n tokens of an abandoned reservation
+func (l *rateLimiter) release(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+float64(n), float64(rateBurst(l.rate)))
+	}
+}
+
+// take takes n tokens without waiting, the next waiter pays for them
+func (l *rateLimiter) take(n int) {
+	_, _ = l.reserve(n)
+}
+
+// wait blocks until n bytes may pass. Waiting for 0 bytes waits until the
+// bytes taken before have been paid for.
+func (l *rateLimiter) wait(n int, deadline <-chan time.Time, die <-chan struct{}) error {
+	for {
+		delay, changed := l.reserve(n)
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			return nil
+		case <-changed:
+			timer.Stop()
+			l.release(n)
+		case <-deadline:
+			timer.Stop()
+			l.release(n)
+			return context.DeadlineExceeded
+		case <-die:
+			timer.Stop()
+			l.release(n)
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// SetRateLimit changes the bandwidth limits of the session in bytes per
+// second, 0 means unlimited. The send limit applies to data frames of all
+// streams, Write blocks until they may be sent, control frames such as window
+// updates are never held back. The receive limit slows
+// down the reading of the underlying connection, so the peer's writes
+// block in turn. Note a receive limit too low delays keepalive as well.
+func (s *Session) SetRateLimit(send, receive int) {
+	s.sendLimiter.setRate(max(send, 0))
+	s.recvLimiter.setRate(max(receive, 0))
+}
+
+// RateLimit returns the bandwidth limits of the session in bytes per second.
+func (s *Session) RateLimit() (send, receive int) {
+	return s.sendLimiter.getRate(), s.recvLimiter.getRate()
+}
+
+// SetRateLimit changes the bandwidth limits of the stream in bytes per
+// second, 0 means unlimited. The send limit blocks Write, the receive
+// limit blocks Read, which slows down the peer with flow control.
+// The limits of the session apply as well.
+func (s *Stream) SetRateLimit(send, receive int) {
+	s.sendLimiter.setRate(max(send, 0))
+	s.recvLimiter.setRate(max(receive, 0))
+}
+
+// RateLimit returns the bandwidth limits of the stream in bytes per second.
+func (s *Stream) RateLimit() (send, receive int) {
+	return s.sendLimiter.getRate(), s.recvLimiter.getRate()
+}
+
+// waitSendLimit blocks until the data frame may be sent, the stream gets its
+// tokens back if the session holds the frame until the deadline
+func (s *Stream) waitSendLimit(f Frame, deadline <-chan time.Time) error {
+	n := headerLen(s.sess.version()) + len(f.data)
+	if err := s.sendLimiter.wait(n, deadline, s.die); err != nil {
+		return err
+	}
+	if err := s.sess.sendLimiter.wait(n, deadline, s.die); err != nil {
+		s.sendLimiter.release(n)
+		return err
+	}
+	return nil
+}
+
+// waitReadLimit blocks until the data read before has been paid for
+func (s *Stream) waitReadLimit() error {
+	if s.recvLimiter.getRate() == 0 {
+		return nil
+	}
+
+	var deadline <-chan time.Time
+	if d, ok := s.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	return s.recvLimiter.wait(0, deadline, s.die)
+}
@@ -0,0 +1,114 @@
+package smux
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1 << 20)
+	start := time.Now()
+	// the burst passes at once, the rest waits
+	for i := 0; i < 4; i++ {
+		if err := l.wait(rateBurst(1<<20), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("4 bursts at 1MB/s took %v", elapsed)
+	}
+
+	// a waiter is released when the limit is lifted
+	l.take(1 << 20)
+	done := make(chan error)
+	go func() { done <- l.wait(1, nil, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	l.setRate(0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter not released when the limit is lifted")
+	}
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.StreamSendRate = 512 << 10
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+
+	if send, recv := local.RateLimit(); send != 512<<10 || recv != 0 {
+		t.Fatalf("stream rate limit %d/%d", send, recv)
+	}
+
+	go func() { _, _ = io.Copy(io.Discard, remote) }()
+	start := time.Now()
+	if _, err := local.Write(make([]byte, 256<<10)); err != nil {
+		t.Fatal(err)
+	}
+	// a tenth of a second passes at once, the rest takes about 200KB / 512KB/s
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("256KB written in %v despite a limit of 512KB/s", elapsed)
+	}
+
+	local.SetRateLimit(0, 0)
+	start = time.Now()
+	if _, err := local.Write(make([]byte, 256<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("256KB written in %v without limit", elapsed)
+	}
+}
+
+func TestRateLimitControlFrames(t *testing.T) {
+	config := DefaultConfig()
+	config.Version = 2
+	config.MaxStreamBuffer = 16 << 10
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+	// the window updates of the server are not held back
+	srv.SetRateLimit(1, 0)
+
+	go func() { _, _ = local.Write(make([]byte, 256<<10)) }()
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(remote, make([]byte, 256<<10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamSendLimitRefund(t *testing.T) {
+	config := DefaultConfig()
+	config.Version = 3
+	cli, srv := newSessionPair(t, config)
+	local, _ := openPair(t, cli, srv)
+	local.SetRateLimit(1000, 0)
+	local.sendLimiter.release(rateBurst(1000))
+
+	// charged with the header of the protocol version
+	frame := newFrame(3, cmdPSH, local.ID())
+	frame.data = make([]byte, 30)
+	if err := local.waitSendLimit(frame, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tokens := local.sendLimiter.tokens; tokens > 100-40+1 {
+		t.Fatalf("stream has %v tokens left", tokens)
+	}
+
+	// the session holds the frame past the deadline, the stream isn't charged
+	cli.SetRateLimit(1000, 0)
+	cli.sendLimiter.take(1000)
+	before := local.sendLimiter.tokens
+	deadline := make(chan time.Time)
+	close(deadline)
+	if err := local.waitSendLimit(frame, deadline); err == nil {
+		t.Fatal("expected the session limit to hold the frame")
+	}
+	if tokens := local.sendLimiter.tokens; tokens < before {
+		t.Fatalf("stream has %v tokens, %v before", tokens, before)
+	}
+}
@@ -0,0 +1,209 @@
+package smux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"unicode/utf8"
+)
+
+// maxResetReason is the maximum length of the reason carried by RST
+const maxResetReason = 1024
+
+// ErrorCode tells the peer why a stream has been reset, codes other than
+// the predefined ones are left to applications.
+type ErrorCode uint32
+
+const (
+	CodeNoError        ErrorCode = iota // aborted without an error
+	CodeInternal                        // internal error of the sender
+	CodeRefused                         // stream refused before any processing, safe to retry
+	CodeCancel                          // stream no longer needed
+	CodeConnectFailed                   // the backend connection of a relay failed
+	CodeNotFound                        // no handler for the requested service
+	CodeTooManyStreams                  // stream refused by Config.MaxStreams or a full accept backlog
+	CodeIdleTimeout                     // stream closed after no reads or writes for its idle timeout
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeNoError:        "no error",
+	CodeInternal:       "internal error",
+	CodeRefused:        "refused",
+	CodeCancel:         "cancel",
+	CodeConnectFailed:  "connect failed",
+	CodeNotFound:       "not found",
+	CodeTooManyStreams: "too many streams",
+	CodeIdleTimeout:    "idle timeout",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code %d", uint32(c))
+}
+
+// StreamError is returned by Read and Write on a stream that has been reset,
+// use errors.As to inspect it.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
+	Reason   string
+	Remote   bool // reset by the remote peer
+}
+
+func (e *StreamError) Error() string {
+	by := "locally"
+	if e.Remote {
+		by = "by peer"
+	}
+	if e.Reason == "" {
+		return fmt.Sprintf("stream %d reset %s: %s", e.StreamID, by, e.Code)
+	}
+	return fmt.Sprintf("stream %d reset %s: %s: %s", e.StreamID, by, e.Code, e.Reason)
+}
+
+// Is reports a refusal for too many streams as ErrTooManyStreams,
+// and an idle timeout as ErrStreamIdle.
+func (e *StreamError) Is(target error) bool {
+	switch target {
+	case ErrTooManyStreams:
+		return e.Code == CodeTooManyStreams
+	case ErrStreamIdle:
+		return e.Code == CodeIdleTimeout
+	}
+	return false
+}
+
+// Reset aborts the stream, unlike Close which ends the stream gracefully
+// with FIN, the peer is told the code and reason, and its pending and
+// subsequent Read and Write fail with *StreamError. So do the local ones.
+// A peer not supporting RST only receives FIN.
+func (s *Stream) Reset(code ErrorCode, reason string) error {
+	if len(reason) > maxResetReason {
+		// cut at a rune boundary, the peer receives valid UTF-8
+		n := maxResetReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+
+	var once bool
+	s.dieOnce.Do(func() {
+		s.setReset(&StreamError{StreamID: s.id, Code: code, Reason: reason})
+		close(s.die)
+		once = true
+	})
+	if !once {
+		return io.ErrClosedPipe
+	}
+
+	var err error
+	if !s.remoteReset() {
+		frame := newFrame(s.sess.version(), cmdFIN, s.id)
+		if s.sess.peerSupports(FeatureReset) {
+			frame = newResetFrame(s.sess.version(), s.id, code, reason)
+		}
+		_, err = s.sess.writeFrame(frame)
+	}
+	s.sess.streamClosed(s.id)
+	return err
+}
+
+// newResetFrame builds a RST frame, format:
+// |4B error code| reason |
+func newResetFrame(version byte, sid uint32, code ErrorCode, reason string) Frame {
+	frame := newFrame(version, cmdRST, sid)
+	frame.data = binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(reason)), uint32(code))
+	frame.data = append(frame.data, reason...)
+	return frame
+}
+
+// refusal is a stream refused by refuseStream, waiting for its RST
+type refusal struct {
+	code   ErrorCode
+	reason string
+}
+
+// refuseStream rejects a SYN from the peer without blocking recvLoop. The
+// refusals pending are sent by controlLoop, up to refusalBacklog of them, a
+// peer flooding SYNs without reading can't pile up goroutines or memory,
+// its streams refused beyond wait for their timeout.
+func (s *Session) refuseStream(sid uint32, code ErrorCode, reason string) {
+	s.log(slog.LevelWarn, "smux stream refused", "stream", sid, "code", code, "reason", reason)
+	s.refusalLock.Lock()
+	pending := len(s.refusals) < refusalBacklog
+	if pending {
+		s.refusals[sid] = refusal{code: code, reason: reason}
+	}
+	s.refusalLock.Unlock()
+	if !pending {
+		s.log(slog.LevelDebug, "smux refusal dropped", "stream", sid, "reason", "too many refusals pending")
+		return
+	}
+	select {
+	case s.chRefusals <- struct{}{}:
+	default:
+	}
+}
+
+// sendRefusals writes the RSTs of the streams refused so far, it gives up on
+// the first failure, the peer isn't reading or the connection is gone
+func (s *Session) sendRefusals() {
+	s.refusalLock.Lock()
+	refusals := s.refusals
+	s.refusals = make(map[uint32]refusal, len(refusals))
+	s.refusalLock.Unlock()
+
+	for sid, r := range refusals {
+		frame := newFrame(s.version(), cmdFIN, sid)
+		if s.peerSupports(FeatureReset) {
+			frame = newResetFrame(s.version(), sid, r.code, r.reason)
+		}
+		if _, err := s.writeFrame(frame); err != nil {
+			return
+		}
+	}
+}
+
+// tooManyStreams checks if Config.MaxStreams is reached, s.streamLock must be held
+func (s *Session) tooManyStreams() bool {
+	return s.config.MaxStreams > 0 && len(s.streams) >= s.config.MaxStreams
+}
+
+// setReset records the reset error, only the first one is kept
+func (s *Stream) setReset(err *StreamError) bool {
+	var once bool
+	s.resetOnce.Do(func() {
+		s.resetErr.Store(err)
+		close(s.chReset)
+		once = true
+	})
+	return once
+}
+
+// resetError returns the reset error, nil if the stream has not been reset
+func (s *Stream) resetError() error {
+	if err, ok := s.resetErr.Load().(*StreamError); ok {
+		return err
+	}
+	return nil
+}
+
+// remoteReset checks if the peer has reset the stream
+func (s *Stream) remoteReset() bool {
+	err, ok := s.resetErr.Load().(*StreamError)
+	return ok && err.Remote
+}
+
+// reset handles RST from the peer, buffered data is discarded
+func (s *Stream) reset(code ErrorCode, reason string) {
+	if s.setReset(&StreamError{StreamID: s.id, Code: code, Reason: reason, Remote: true}) {
+		if n := s.recycleTokens(); n > 0 {
+			s.sess.returnTokens(n)
+		}
+		s.notifyReadEvent()
+	}
+}
@@ -0,0 +1,908 @@
+package smux
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resumable and bonded sessions run over resumeConn instead of a raw
+// connection. It spreads chunks of the byte stream over a set of raw
+// connections called links, and keeps every chunk written in a bounded
+// replay buffer until the peer acknowledges it has been consumed. The
+// receiver puts the chunks back in order, so links may be added, fail or
+// be replaced at any time: after a link failure, unacknowledged chunks
+// are sent again on the remaining links, after reconnecting, both sides
+// tell how much they have received and replay what is missing.
+//
+// On each link, the client opens with:
+//
+//	|4B magic| 1B op| 16B token| 8B bytes received|
+//
+// the token travels in clear, so a joining link is challenged with:
+//
+//	|16B challenge|
+//
+// and proves it knows Config.Secret with:
+//
+//	|32B HMAC-SHA256 of the challenge and the opening|
+//
+// and the server answers:
+//
+//	|1B status| 16B token| 8B bytes received|
+//
+// then records flow in both directions:
+//
+//	|1B type| 8B offset or ack| 4B length| payload |
+const (
+	resumeMagic = "SMXR"
+
+	resumeOpNew  byte = 0 // first link of a session
+	resumeOpJoin byte = 1 // additional or replacement link
+
+	resumeStatusOK      byte = 0
+	resumeStatusUnknown byte = 1
+
+	recordData byte = 1 // chunk starting at offset
+	recordAck  byte = 2 // bytes consumed so far
+
+	sizeOfResumeToken     = 16
+	sizeOfClientHandshake = len(resumeMagic) + 1 + sizeOfResumeToken + 8
+	sizeOfServerHandshake = 1 + sizeOfResumeToken + 8
+	sizeOfChallenge       = 16
+	sizeOfJoinProof       = sha256.Size
+	sizeOfRecordHeader    = 1 + 8 + 4
+
+	maxRecordPayload     = 65536
+	defaultResumeBuffer  = 4 << 20
+	defaultResumeTimeout = 30 * time.Second
+	handshakeTimeout     = 10 * time.Second
+	ackInterval          = 200 * time.Millisecond
+	redialBackoff        = 500 * time.Millisecond
+
+	// a link which can't take a record in time is marked down, its chunks
+	// are sent again on the other links
+	linkWriteTimeout = 5 * time.Second
+)
+
+var (
+	ErrResumeRejected = errors.New("session resumption rejected, the peer does not know it")
+	ErrResumeTimeout  = errors.New("session not resumed in time")
+	ErrResumeSecret   = errors.New("session resumption requires Config.Secret")
+)
+
+type resumeToken [sizeOfResumeToken]byte
+
+// chunk is a piece of the byte stream, it's always sent again as a whole,
+// so both sides see the same chunk boundaries.
+type chunk struct {
+	offset uint64
+	data   []byte
+}
+
+// resumeLink is a raw connection carrying records
+type resumeLink struct {
+	slot    int // index of the dial function on the client side
+	conn    net.Conn
+	timeout time.Duration // write timeout of a record
+	wmu     sync.Mutex    // serializes writes of records
+}
+
+func (l *resumeLink) write(typ byte, value uint64, payload []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	return l.writeLocked(typ, value, payload)
+}
+
+// writeLocked writes a record before the write timeout, so a stalled link
+// fails instead of blocking the writers, l.wmu must be held
+func (l *resumeLink) writeLocked(typ byte, value uint64, payload []byte) error {
+	_ = l.conn.SetWriteDeadline(time.Now().Add(l.timeout))
+	return writeRecord(l.conn, typ, value, payload)
+}
+
+// resumeConn implements net.Conn on top of a changing set of links.
+type resumeConn struct {
+	token       resumeToken
+	secret      []byte // authenticates the joining links
+	bufferSize  int
+	timeout     time.Duration
+	linkTimeout time.Duration                             // write timeout of the links
+	dials       []func(context.Context) (net.Conn, error) // client side only
+	onClose     func()
+
+	mu       sync.Mutex
+	links    []*resumeLink // live links
+	attaches int           // links attached so far
+	next     int           // round-robin cursor over links
+	local    net.Addr
+	remote   net.Addr
+	chunks   []chunk // written but not acknowledged, ordered by offset
+	pending  int     // bytes in chunks
+	sent     uint64  // bytes written
+	reorder  map[uint64][]byte
+	rbuf     []byte // received in order but not read
+	received uint64 // bytes received in order
+	consumed uint64 // bytes read
+	acked    uint64 // last ack sent
+	err      error  // permanent error
+
+	readDeadline time.Time
+
+	chRead  chan struct{} // data arrived or read deadline changed
+	chSpace chan struct{} // replay buffer freed
+	chAck   chan struct{} // ack is due
+	die     chan struct{}
+}
+
+func newResumeConn(token resumeToken, config *Config) *resumeConn {
+	c := &resumeConn{
+		token:       token,
+		secret:      config.Secret,
+		bufferSize:  config.ResumeBuffer,
+		timeout:     config.ResumeTimeout,
+		linkTimeout: linkWriteTimeout,
+		reorder:     make(map[uint64][]byte),
+		chRead:      make(chan struct{}, 1),
+		chSpace:     make(chan struct{}, 1),
+		chAck:       make(chan struct{}, 1),
+		die:         make(chan struct{}),
+	}
+	if c.bufferSize <= 0 {
+		c.bufferSize = defaultResumeBuffer
+	}
+	if c.timeout <= 0 {
+		c.timeout = defaultResumeTimeout
+	}
+	go c.ackLoop()
+	return c
+}
+
+// DialResumable dials a client session which survives reconnections: when
+// the connection drops, dial is called again until the server resumes the
+// session or Config.ResumeTimeout expires. The server must accept
+// connections with a Resumer, both share Config.Secret.
+func DialResumable(ctx context.Context, dial func(context.Context) (net.Conn, error), config *Config) (*Session, error) {
+	return DialBonded(ctx, []func(context.Context) (net.Conn, error){dial}, config)
+}
+
+// DialBonded dials a client session spreading its frames over one
+// connection per dial function, such as one per address returned by
+// netutil.Addresses.Preformat. Frames are put back in order by the
+// receiver, failed connections are dialed again in the background, and the
+// session keeps on working as long as one connection is alive, or one
+// comes back within Config.ResumeTimeout. The server must accept
+// connections with a Resumer, both share Config.Secret which authenticates
+// the connections joining the session.
+//
+// The first dial function must succeed, the others are retried in the
+// background if they fail.
+func DialBonded(ctx context.Context, dials []func(context.Context) (net.Conn, error), config *Config) (*Session, error) {
+	if len(dials) == 0 {
+		return nil, errors.New("no dial function")
+	}
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := VerifyConfig(config); err != nil {
+		return nil, err
+	}
+	if len(config.Secret) == 0 {
+		return nil, ErrResumeSecret
+	}
+
+	conn, err := dials[0](ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, _, err := clientHandshake(conn, resumeOpNew, resumeToken{}, 0, config.Secret)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	rc := newResumeConn(token, config)
+	rc.dials = dials
+	_ = rc.attach(conn, 0, 0)
+	for slot := 1; slot < len(dials); slot++ {
+		if err := rc.join(ctx, slot); err != nil {
+			go rc.redialLoop(slot)
+		}
+	}
+	return newSession(config, rc, true), nil
+}
+
+// Resumer accepts connections of resumable and bonded sessions on the
+// server side, it keeps the sessions whose connections all dropped until
+// one is back or Config.ResumeTimeout expires.
+type Resumer struct {
+	config   *Config
+	mu       sync.Mutex
+	sessions map[resumeToken]*resumeEntry
+}
+
+type resumeEntry struct {
+	conn *resumeConn
+	sess *Session
+}
+
+// NewResumer creates a Resumer, the sessions are created with config,
+// whose Secret must be set.
+func NewResumer(config *Config) *Resumer {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Resumer{config: config, sessions: make(map[resumeToken]*resumeEntry)}
+}
+
+// Accept performs the handshake on a newly accepted connection.
+// It returns either a new session and false, which the caller serves as
+// usual, or an existing session and true, which conn has just joined, and
+// which keeps on being served where it was.
+func (r *Resumer) Accept(conn net.Conn) (*Session, bool, error) {
+	if len(r.config.Secret) == 0 {
+		_ = conn.Close()
+		return nil, false, ErrResumeSecret
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	var hello [sizeOfClientHandshake]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+	if string(hello[:len(resumeMagic)]) != resumeMagic {
+		_ = conn.Close()
+		return nil, false, fmt.Errorf("%w: bad resumption magic", ErrInvalidProtocol)
+	}
+	op := hello[len(resumeMagic)]
+	var token resumeToken
+	copy(token[:], hello[len(resumeMagic)+1:])
+	peerReceived := binary.LittleEndian.Uint64(hello[len(resumeMagic)+1+sizeOfResumeToken:])
+
+	if op == resumeOpNew {
+		if _, err := rand.Read(token[:]); err != nil {
+			_ = conn.Close()
+			return nil, false, err
+		}
+
+		// registered before answering, since other links may join right after
+		rc := newResumeConn(token, r.config)
+		rc.onClose = func() { r.remove(token) }
+		sess := newSession(r.config, rc, false)
+		r.mu.Lock()
+		r.sessions[token] = &resumeEntry{conn: rc, sess: sess}
+		r.mu.Unlock()
+
+		if err := serverHandshake(conn, resumeStatusOK, token, 0); err != nil {
+			_ = conn.Close()
+			_ = sess.Close()
+			return nil, false, err
+		}
+		_ = rc.attach(conn, -1, 0)
+		return sess, false, nil
+	}
+
+	if err := challengeJoin(conn, r.config.Secret, token, hello[:]); err != nil {
+		if errors.Is(err, ErrResumeRejected) {
+			_ = serverHandshake(conn, resumeStatusUnknown, token, 0)
+		}
+		_ = conn.Close()
+		return nil, false, err
+	}
+
+	r.mu.Lock()
+	entry := r.sessions[token]
+	r.mu.Unlock()
+	if entry == nil {
+		_ = serverHandshake(conn, resumeStatusUnknown, token, 0)
+		_ = conn.Close()
+		return nil, false, ErrResumeRejected
+	}
+
+	if err := serverHandshake(conn, resumeStatusOK, token, entry.conn.receivedBytes()); err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+	if err := entry.conn.attach(conn, -1, peerReceived); err != nil {
+		return nil, false, err
+	}
+	return entry.sess, true, nil
+}
+
+// Len returns the number of resumable sessions.
+func (r *Resumer) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+func (r *Resumer) remove(token resumeToken) {
+	r.mu.Lock()
+	delete(r.sessions, token)
+	r.mu.Unlock()
+}
+
+func clientHandshake(conn net.Conn, op byte, token resumeToken, received uint64, secret []byte) (resumeToken, uint64, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 0, sizeOfClientHandshake)
+	hello = append(hello, resumeMagic...)
+	hello = append(hello, op)
+	hello = append(hello, token[:]...)
+	hello = binary.LittleEndian.AppendUint64(hello, received)
+	if _, err := conn.Write(hello); err != nil {
+		return token, 0, err
+	}
+	if op == resumeOpJoin {
+		var challenge [sizeOfChallenge]byte
+		if _, err := io.ReadFull(conn, challenge[:]); err != nil {
+			return token, 0, err
+		}
+		proof, err := joinProof(secret, token, challenge[:], hello)
+		if err != nil {
+			return token, 0, err
+		}
+		if _, err := conn.Write(proof); err != nil {
+			return token, 0, err
+		}
+	}
+
+	var reply [sizeOfServerHandshake]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return token, 0, err
+	}
+	if reply[0] != resumeStatusOK {
+		return token, 0, ErrResumeRejected
+	}
+	copy(token[:], reply[1:])
+	return token, binary.LittleEndian.Uint64(reply[1+sizeOfResumeToken:]), nil
+}
+
+func serverHandshake(conn net.Conn, status byte, token resumeToken, received uint64) error {
+	defer conn.SetDeadline(time.Time{})
+
+	reply := make([]byte, 0, sizeOfServerHandshake)
+	reply = append(reply, status)
+	reply = append(reply, token[:]...)
+	reply = binary.LittleEndian.AppendUint64(reply, received)
+	_, err := conn.Write(reply)
+	return err
+}
+
+// challengeJoin makes a joining link prove it knows Config.Secret, so a
+// token sniffed on another link is useless, and a proof can't be replayed
+func challengeJoin(conn net.Conn, secret []byte, token resumeToken, hello []byte) error {
+	var challenge [sizeOfChallenge]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return err
+	}
+	if _, err := conn.Write(challenge[:]); err != nil {
+		return err
+	}
+	var proof [sizeOfJoinProof]byte
+	if _, err := io.ReadFull(conn, proof[:]); err != nil {
+		return err
+	}
+
+	expected, err := joinProof(secret, token, challenge[:], hello)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof[:], expected) {
+		return fmt.Errorf("%w: bad proof", ErrResumeRejected)
+	}
+	return nil
+}
+
+// joinProof computes the HMAC of the challenge and the opening of a joining
+// link, keyed by Config.Secret and the token
+func joinProof(secret []byte, token resumeToken, challenge, hello []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, secret, token[:], "smux resume join", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	mac.Write(hello)
+	return mac.Sum(nil), nil
+}
+
+// join dials the link of slot and attaches it
+func (c *resumeConn) join(ctx context.Context, slot int) error {
+	conn, err := c.dials[slot](ctx)
+	if err != nil {
+		return err
+	}
+	_, peerReceived, err := clientHandshake(conn, resumeOpJoin, c.token, c.receivedBytes(), c.secret)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return c.attach(conn, slot, peerReceived)
+}
+
+// attach adds a link, then replays on it what the peer has not received
+func (c *resumeConn) attach(conn net.Conn, slot int, peerReceived uint64) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return c.err
+	}
+	if peerReceived > c.sent || (len(c.chunks) > 0 && peerReceived < c.chunks[0].offset) {
+		c.mu.Unlock()
+		_ = conn.Close()
+		err := fmt.Errorf("%w: peer received %d bytes out of %d", ErrInvalidProtocol, peerReceived, c.sent)
+		c.fail(err)
+		return err
+	}
+	link := &resumeLink{slot: slot, conn: conn, timeout: c.linkTimeout}
+	c.attaches++
+	c.links = append(c.links, link)
+	c.local, c.remote = conn.LocalAddr(), conn.RemoteAddr()
+	var missing []chunk
+	for _, ch := range c.chunks {
+		if ch.offset+uint64(len(ch.data)) > peerReceived {
+			missing = append(missing, ch)
+		}
+	}
+	// hold the link until the replay is written, so newer chunks follow it
+	link.wmu.Lock()
+	c.mu.Unlock()
+
+	go c.readLink(link)
+	var err error
+	for _, ch := range missing {
+		if err = link.writeLocked(recordData, ch.offset, ch.data); err != nil {
+			break
+		}
+	}
+	link.wmu.Unlock()
+	if err != nil {
+		c.linkDown(link)
+	}
+	return nil
+}
+
+// pickLink returns the next live link in turn, c.mu must be held
+func (c *resumeConn) pickLink() *resumeLink {
+	if len(c.links) == 0 {
+		return nil
+	}
+	c.next = (c.next + 1) % len(c.links)
+	return c.links[c.next]
+}
+
+// ackChunks drops the chunks fully consumed by the peer, c.mu must be held
+func (c *resumeConn) ackChunks(consumed uint64) {
+	var n int
+	for n < len(c.chunks) && c.chunks[n].offset+uint64(len(c.chunks[n].data)) <= consumed {
+		c.pending -= len(c.chunks[n].data)
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	c.chunks = append(c.chunks[:0:0], c.chunks[n:]...)
+	select {
+	case c.chSpace <- struct{}{}:
+	default:
+	}
+}
+
+// linkDown removes a failed or stalled link. Unacknowledged chunks are sent
+// again on the remaining links, since some may have been lost with it.
+func (c *resumeConn) linkDown(link *resumeLink) {
+	c.mu.Lock()
+	idx := -1
+	for i, l := range c.links {
+		if l == link {
+			idx = i
+		}
+	}
+	if idx < 0 || c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	_ = link.conn.Close()
+	c.links = append(c.links[:idx:idx], c.links[idx+1:]...)
+	remaining, attaches := len(c.links), c.attaches
+	unacked := append([]chunk(nil), c.chunks...)
+	c.mu.Unlock()
+
+	if remaining == 0 {
+		go c.waitResume(attaches)
+	} else if len(unacked) > 0 {
+		go c.resend(unacked)
+	}
+	if c.dials != nil {
+		go c.redialLoop(link.slot)
+	}
+}
+
+// resend spreads chunks over the live links
+func (c *resumeConn) resend(chunks []chunk) {
+	for _, ch := range chunks {
+		c.mu.Lock()
+		link := c.pickLink()
+		c.mu.Unlock()
+		if link == nil {
+			return // replayed on attach
+		}
+		if err := link.write(recordData, ch.offset, ch.data); err != nil {
+			c.linkDown(link)
+		}
+	}
+}
+
+// waitResume fails the connection if no link is attached in time
+func (c *resumeConn) waitResume(attaches int) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		c.mu.Lock()
+		down := len(c.links) == 0 && c.attaches == attaches
+		c.mu.Unlock()
+		if down {
+			c.fail(ErrResumeTimeout)
+		}
+	case <-c.die:
+	}
+}
+
+// redialLoop dials the link of slot again until it joins
+func (c *resumeConn) redialLoop(slot int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.die:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := c.join(ctx, slot)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrResumeRejected) {
+			c.fail(err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(redialBackoff):
+		}
+	}
+}
+
+// readLink reads records from a link until it fails
+func (c *resumeConn) readLink(link *resumeLink) {
+	var hdr [sizeOfRecordHeader]byte
+	for {
+		if _, err := io.ReadFull(link.conn, hdr[:]); err != nil {
+			c.linkDown(link)
+			return
+		}
+		value := binary.LittleEndian.Uint64(hdr[1:])
+		size := binary.LittleEndian.Uint32(hdr[9:])
+
+		switch hdr[0] {
+		case recordAck:
+			c.mu.Lock()
+			if value <= c.sent {
+				c.ackChunks(value)
+			}
+			c.mu.Unlock()
+		case recordData:
+			if size == 0 || size > maxRecordPayload {
+				c.fail(fmt.Errorf("%w: bad record size %d", ErrInvalidProtocol, size))
+				return
+			}
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(link.conn, payload); err != nil {
+				c.linkDown(link)
+				return
+			}
+			if err := c.onData(value, payload); err != nil {
+				c.fail(err)
+				return
+			}
+		default:
+			c.fail(fmt.Errorf("%w: unknown record type %d", ErrInvalidProtocol, hdr[0]))
+			return
+		}
+	}
+}
+
+// onData delivers a chunk, chunks ahead of the stream wait in the reorder
+// buffer. The peer never sends beyond its replay buffer past what has been
+// consumed, so together with the data not read yet, they are bounded by the
+// local one, a chunk further ahead is a protocol error.
+func (c *resumeConn) onData(offset uint64, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if end := offset + uint64(len(payload)); end < offset || end > c.consumed+uint64(c.bufferSize) {
+		return fmt.Errorf("%w: chunk at %d beyond the resume buffer", ErrInvalidProtocol, offset)
+	}
+	if offset > c.received {
+		c.reorder[offset] = payload
+		return nil
+	}
+	if skip := c.received - offset; skip < uint64(len(payload)) {
+		c.deliver(payload[skip:])
+	}
+	for {
+		payload, ok := c.reorder[c.received]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.received)
+		c.deliver(payload)
+	}
+	return nil
+}
+
+// deliver appends data in order, c.mu must be held
+func (c *resumeConn) deliver(data []byte) {
+	c.rbuf = append(c.rbuf, data...)
+	c.received += uint64(len(data))
+	select {
+	case c.chRead <- struct{}{}:
+	default:
+	}
+}
+
+// ackLoop tells the peer how much has been consumed, so the peer can free
+// its replay buffer. Acks are sent in their own goroutine, thus readLink
+// never blocks on writing.
+func (c *resumeConn) ackLoop() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.chAck:
+		case <-c.die:
+			return
+		}
+
+		c.mu.Lock()
+		consumed, acked := c.consumed, c.acked
+		var link *resumeLink
+		if consumed != acked {
+			link = c.pickLink()
+		}
+		c.mu.Unlock()
+		if link == nil {
+			continue
+		}
+
+		if err := link.write(recordAck, consumed, nil); err != nil {
+			c.linkDown(link)
+			continue
+		}
+		c.mu.Lock()
+		if consumed > c.acked {
+			c.acked = consumed
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *resumeConn) receivedBytes() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.received
+}
+
+// fail closes the connection permanently
+func (c *resumeConn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	for _, link := range c.links {
+		_ = link.conn.Close()
+	}
+	c.links = nil
+	close(c.die)
+	c.mu.Unlock()
+
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// Read implements net.Conn
+func (c *resumeConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.rbuf) > 0 {
+			n := copy(b, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			if len(c.rbuf) == 0 {
+				c.rbuf = nil
+			}
+			c.consumed += uint64(n)
+			due := c.consumed-c.acked >= uint64(c.bufferSize/4)
+			c.mu.Unlock()
+			if due {
+				select {
+				case c.chAck <- struct{}{}:
+				default:
+				}
+			}
+			return n, nil
+		}
+		err, deadline := c.err, c.readDeadline
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case <-c.chRead:
+		case <-c.die:
+		case <-timeout:
+			return 0, &net.OpError{Op: "read", Net: "resume", Err: errTimeout{}}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write implements net.Conn, it blocks while the replay buffer is full,
+// data written while all links are down is sent once one is back.
+func (c *resumeConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		if err := c.waitSpace(); err != nil {
+			return written, err
+		}
+
+		c.mu.Lock()
+		n := min(len(b), c.bufferSize-c.pending, maxRecordPayload)
+		ch := chunk{offset: c.sent, data: append([]byte(nil), b[:n]...)}
+		c.chunks = append(c.chunks, ch)
+		c.pending += n
+		c.sent += uint64(n)
+		link := c.pickLink()
+		c.mu.Unlock()
+		if link != nil {
+			if err := link.write(recordData, ch.offset, ch.data); err != nil {
+				c.linkDown(link)
+			}
+		}
+
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// waitSpace blocks until the replay buffer has room
+func (c *resumeConn) waitSpace() error {
+	for {
+		c.mu.Lock()
+		full, err := c.pending >= c.bufferSize, c.err
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !full {
+			return nil
+		}
+
+		select {
+		case <-c.chSpace:
+		case <-c.die:
+		}
+	}
+}
+
+// Close implements net.Conn
+func (c *resumeConn) Close() error {
+	c.mu.Lock()
+	closed := c.err != nil
+	c.mu.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+	c.fail(io.ErrClosedPipe)
+	return nil
+}
+
+// LocalAddr implements net.Conn, it's the address of the latest link
+func (c *resumeConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.local
+}
+
+// RemoteAddr implements net.Conn, it's the address of the latest link
+func (c *resumeConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// SetDeadline implements net.Conn, only the read deadline is supported
+func (c *resumeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (c *resumeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	select {
+	case c.chRead <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn, writes only block on a full replay
+// buffer, which is bounded by Config.ResumeTimeout.
+func (c *resumeConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Links returns the number of live connections under a resumable or bonded
+// session, or -1 for other sessions.
+func (s *Session) Links() int {
+	rc, ok := s.conn.(*resumeConn)
+	if !ok {
+		return -1
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.links)
+}
+
+// writeRecord writes a record in one call
+func writeRecord(w io.Writer, typ byte, value uint64, payload []byte) error {
+	buf := bytes.NewBuffer(make([]byte, 0, sizeOfRecordHeader+len(payload)))
+	buf.WriteByte(typ)
+	_ = binary.Write(buf, binary.LittleEndian, value)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// errTimeout is a net.Error reporting a timeout
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
@@ -0,0 +1,307 @@
+package smux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resumePipe dials in-memory connections accepted by a Resumer, the server
+// sessions echo every stream.
+type resumePipe struct {
+	resumer *Resumer
+	mu      sync.Mutex
+	links   []net.Conn
+}
+
+// resumeConfig returns the config of resumable sessions, they require a secret
+func resumeConfig() *Config {
+	config := DefaultConfig()
+	config.Secret = []byte("resume secret")
+	return config
+}
+
+func (p *resumePipe) dial(context.Context) (net.Conn, error) {
+	a, b := net.Pipe()
+	p.mu.Lock()
+	p.links = append(p.links, a)
+	p.mu.Unlock()
+
+	go func() {
+		sess, resumed, err := p.resumer.Accept(b)
+		if err != nil || resumed {
+			return
+		}
+		for {
+			stream, err := sess.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(stream, stream)
+				_ = stream.Close()
+			}()
+		}
+	}()
+	return a, nil
+}
+
+// drop breaks the latest connection
+func (p *resumePipe) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.links[len(p.links)-1].Close()
+}
+
+// dialed returns the number of connections dialed so far
+func (p *resumePipe) dialed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.links)
+}
+
+func TestSessionResume(t *testing.T) {
+	config := resumeConfig()
+	config.ResumeBuffer = 64 << 10
+	pipe := &resumePipe{resumer: NewResumer(config)}
+	cli, err := DialResumable(context.Background(), pipe.dial, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var sent, echoed bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(&echoed, stream, 256<<10)
+		done <- err
+	}()
+
+	chunk := make([]byte, 1024)
+	for i := 0; i < 256; i++ {
+		for j := range chunk {
+			chunk[j] = byte(i + j)
+		}
+		if i%64 == 32 {
+			pipe.drop()
+		}
+		if _, err := stream.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		sent.Write(chunk)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent.Bytes(), echoed.Bytes()) {
+		t.Fatal("echoed data differs after resumption")
+	}
+	if n := pipe.dialed(); n < 2 {
+		t.Fatalf("expected reconnections, got %d connections", n)
+	}
+	if n := pipe.resumer.Len(); n != 1 {
+		t.Fatalf("expected 1 resumable session, got %d", n)
+	}
+
+	_ = cli.Close()
+}
+
+func TestSessionBonded(t *testing.T) {
+	config := resumeConfig()
+	pipe := &resumePipe{resumer: NewResumer(config)}
+	dials := []func(context.Context) (net.Conn, error){pipe.dial, pipe.dial, pipe.dial}
+	cli, err := DialBonded(context.Background(), dials, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if n := cli.Links(); n != 3 {
+		t.Fatalf("expected 3 links, got %d", n)
+	}
+
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var echoed bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(&echoed, stream, 1<<20)
+		done <- err
+	}()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for i := 0; i < len(data); i += 4096 {
+		if i == len(data)/2 {
+			pipe.drop()
+		}
+		if _, err := stream.Write(data[i : i+4096]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, echoed.Bytes()) {
+		t.Fatal("echoed data differs over bonded links")
+	}
+
+	// the dropped link is dialed again
+	deadline := time.Now().Add(5 * time.Second)
+	for cli.Links() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 links again, got %d", cli.Links())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := pipe.dialed(); n != 4 {
+		t.Fatalf("expected 4 connections dialed, got %d", n)
+	}
+}
+
+func TestSessionResumeRejected(t *testing.T) {
+	resumer := NewResumer(resumeConfig())
+	a, b := net.Pipe()
+	go func() { _, _, _ = resumer.Accept(b) }()
+
+	_, _, err := clientHandshake(a, resumeOpJoin, resumeToken{1}, 0, resumeConfig().Secret)
+	if !errors.Is(err, ErrResumeRejected) {
+		t.Fatalf("expected ErrResumeRejected, got %v", err)
+	}
+}
+
+func TestSessionResumeHijack(t *testing.T) {
+	config := resumeConfig()
+	pipe := &resumePipe{resumer: NewResumer(config)}
+	cli, err := DialResumable(context.Background(), pipe.dial, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// the token is sniffed, not the secret
+	token := cli.conn.(*resumeConn).token
+	a, b := net.Pipe()
+	go func() { _, _, _ = pipe.resumer.Accept(b) }()
+	_, _, err = clientHandshake(a, resumeOpJoin, token, 0, []byte("guessed secret"))
+	if !errors.Is(err, ErrResumeRejected) {
+		t.Fatalf("expected ErrResumeRejected, got %v", err)
+	}
+	if n := cli.Links(); n != 1 {
+		t.Fatalf("expected 1 link, got %d", n)
+	}
+
+	if _, err := DialResumable(context.Background(), pipe.dial, DefaultConfig()); err != ErrResumeSecret {
+		t.Fatalf("expected ErrResumeSecret, got %v", err)
+	}
+}
+
+func TestSessionResumeTimeout(t *testing.T) {
+	config := resumeConfig()
+	config.ResumeTimeout = 200 * time.Millisecond
+	pipe := &resumePipe{resumer: NewResumer(config)}
+	var dialed bool
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if dialed {
+			return nil, errors.New("unreachable")
+		}
+		dialed = true
+		return pipe.dial(ctx)
+	}
+	cli, err := DialResumable(context.Background(), dial, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	pipe.drop()
+	_ = cli.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.AcceptStream(); !errors.Is(err, ErrResumeTimeout) {
+		t.Fatalf("expected ErrResumeTimeout, got %v", err)
+	}
+
+	// the server session expires as well
+	deadline := time.Now().Add(5 * time.Second)
+	for pipe.resumer.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server session not expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSessionResumeReorderBounded(t *testing.T) {
+	config := resumeConfig()
+	config.ResumeBuffer = 1024
+	c := newResumeConn(resumeToken{}, config)
+	defer c.Close()
+
+	if err := c.onData(512, make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.onData(1024, make([]byte, 1)); !errors.Is(err, ErrInvalidProtocol) {
+		t.Fatalf("expected ErrInvalidProtocol, got %v", err)
+	}
+	if len(c.reorder) != 1 {
+		t.Fatalf("expected 1 chunk reordered, got %d", len(c.reorder))
+	}
+}
+
+func TestSessionBondedStalledLink(t *testing.T) {
+	config := resumeConfig()
+	c := newResumeConn(resumeToken{}, config)
+	c.linkTimeout = 50 * time.Millisecond
+	defer c.Close()
+	peer := newResumeConn(resumeToken{}, config)
+	defer peer.Close()
+
+	// the peer never reads the second link
+	a1, b1 := net.Pipe()
+	a2, b2 := net.Pipe()
+	defer b2.Close()
+	_ = c.attach(a1, 0, 0)
+	_ = c.attach(a2, 1, 0)
+	_ = peer.attach(b1, -1, 0)
+
+	var sent bytes.Buffer
+	for i := 0; i < 4; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 1024)
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		sent.Write(msg)
+	}
+
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, sent.Len())
+	if _, err := io.ReadFull(peer, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent.Bytes(), received) {
+		t.Fatal("received data differs")
+	}
+	c.mu.Lock()
+	links := len(c.links)
+	c.mu.Unlock()
+	if links != 1 {
+		t.Fatalf("expected the stalled link down, got %d links", links)
+	}
+}
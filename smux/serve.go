@@ -0,0 +1,111 @@
+package smux
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// MetaService is the metadata key naming the service a stream is opened for.
+const MetaService = "service"
+
+// A Handler serves the streams opened for a service, the stream is reset
+// with CodeInternal if ServeStream panics.
+type Handler interface {
+	ServeStream(stream *Stream)
+}
+
+// HandlerFunc adapts a function to Handler.
+type HandlerFunc func(stream *Stream)
+
+// ServeStream calls f(stream).
+func (f HandlerFunc) ServeStream(stream *Stream) {
+	f(stream)
+}
+
+// ServeMux dispatches accepted streams to the handler registered for the
+// service named by their metadata, in the manner of http.ServeMux.
+// Streams for unknown services are reset with CodeNotFound, unless a
+// handler has been registered for the empty name.
+type ServeMux struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for the service,
+// it panics if a handler already exists for the service.
+func (m *ServeMux) Handle(service string, handler Handler) {
+	if handler == nil {
+		panic("smux: nil handler")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exist := m.handlers[service]; exist {
+		panic(fmt.Sprintf("smux: multiple registrations for service %q", service))
+	}
+	m.handlers[service] = handler
+}
+
+// HandleFunc registers the handler function for the service.
+func (m *ServeMux) HandleFunc(service string, handler func(stream *Stream)) {
+	m.Handle(service, HandlerFunc(handler))
+}
+
+// Handler returns the handler for the stream and the service it asked for,
+// the handler is nil if none is registered.
+func (m *ServeMux) Handler(stream *Stream) (Handler, string) {
+	service := stream.meta.Get(MetaService)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if handler, ok := m.handlers[service]; ok {
+		return handler, service
+	}
+	return m.handlers[""], service
+}
+
+// ServeStream dispatches the stream to its handler.
+func (m *ServeMux) ServeStream(stream *Stream) {
+	handler, service := m.Handler(stream)
+	if handler == nil {
+		_ = stream.Reset(CodeNotFound, fmt.Sprintf("service %q not found", service))
+		return
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			_ = stream.Reset(CodeInternal, fmt.Sprintf("service %q: %v", service, v))
+		}
+	}()
+	handler.ServeStream(stream)
+}
+
+// Serve accepts streams on the session and serves each in its own
+// goroutine, until AcceptStream fails, whose error is returned.
+func (m *ServeMux) Serve(sess *Session) error {
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go m.ServeStream(stream)
+	}
+}
+
+// OpenService opens a stream for the service, meta is sent along
+// and may be nil.
+func (s *Session) OpenService(ctx context.Context, service string, meta Metadata) (*Stream, error) {
+	meta = maps.Clone(meta)
+	if meta == nil {
+		meta = make(Metadata, 1)
+	}
+	meta[MetaService] = service
+	return s.OpenStreamContext(ctx, meta)
+}
@@ -0,0 +1,63 @@
+package smux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestServeMux(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+
+	mux := NewServeMux()
+	mux.HandleFunc("echo", func(stream *Stream) {
+		defer stream.Close()
+		_, _ = io.Copy(stream, stream)
+	})
+	mux.HandleFunc("panic", func(*Stream) {
+		panic("boom")
+	})
+	go func() { _ = mux.Serve(srv) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.OpenService(ctx, "echo", Metadata{"user": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.CloseWrite()
+	if data, err := io.ReadAll(stream); err != nil || string(data) != "hello" {
+		t.Fatalf("echo: %q, %v", data, err)
+	}
+
+	for service, code := range map[string]ErrorCode{"missing": CodeNotFound, "panic": CodeInternal} {
+		stream, err := cli.OpenService(ctx, service, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+		var serr *StreamError
+		if _, err := stream.Read(make([]byte, 1)); !errors.As(err, &serr) || serr.Code != code {
+			t.Fatalf("service %s: expected %s, got %v", service, code, err)
+		}
+	}
+}
+
+func TestServeMuxDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic on duplicate registration")
+		}
+	}()
+
+	mux := NewServeMux()
+	mux.HandleFunc("shell", func(*Stream) {})
+	mux.HandleFunc("shell", func(*Stream) {})
+}
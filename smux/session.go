@@ -5,7 +5,10 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -16,6 +19,20 @@ const (
 	defaultAcceptBacklog = 1024
 	maxShaperSize        = 1024
 	openCloseTimeout     = 30 * time.Second // stream open/close timeout
+	shutdownPollInterval = 100 * time.Millisecond
+
+	// the frames queued in the shaper are handed to sendLoop in batches of
+	// up to this many frames or bytes, written to the connection at once
+	sendBatchFrames = 64
+	sendBatchBytes  = 256 << 10
+
+	// control frames answering the peer, such as PONG, are queued up to
+	// this many, the ones beyond are dropped
+	controlBacklog = 64
+
+	// refused streams waiting for their RST, a peer opening more streams
+	// without reading the refusals sees the ones beyond time out
+	refusalBacklog = 4096
 )
 
 // define frame class
@@ -27,17 +44,41 @@ const (
 )
 
 var (
-	ErrInvalidProtocol = errors.New("invalid protocol")
-	ErrConsumed        = errors.New("peer consumed more than sent")
-	ErrGoAway          = errors.New("stream id overflows, should start a new connection")
-	ErrTimeout         = errors.New("timeout")
-	ErrWouldBlock      = errors.New("operation would block on IO")
+	ErrInvalidProtocol  = errors.New("invalid protocol")
+	ErrConsumed         = errors.New("peer consumed more than sent")
+	ErrGoAway           = errors.New("stream id overflows, should start a new connection")
+	ErrTimeout          = errors.New("timeout")
+	ErrWouldBlock       = errors.New("operation would block on IO")
+	ErrBrokenPipe       = errors.New("broken pipe, peer has closed the read side")
+	ErrNotSupported     = errors.New("not supported by the remote peer")
+	ErrTooManyStreams   = errors.New("too many streams")
+	ErrStreamIdle       = errors.New("stream idle timeout")
+	ErrKeepAliveTimeout = errors.New("keepalive timeout, no data from the peer")
 )
 
+// GoAwayError is returned when opening a stream on a session which the remote
+// peer is draining, the caller should open a new session, probably elsewhere.
+type GoAwayError struct {
+	// LastStreamID is the last stream id opened by this side that
+	// the peer has accepted, streams above it have been rejected.
+	LastStreamID uint32
+}
+
+func (e *GoAwayError) Error() string {
+	return fmt.Sprintf("remote peer is going away, last accepted stream id %d", e.LastStreamID)
+}
+
+// Is makes errors.Is(err, ErrGoAway) hold for GoAwayError.
+func (e *GoAwayError) Is(target error) bool {
+	return target == ErrGoAway
+}
+
 type writeRequest struct {
 	class  CLASSID
 	frame  Frame
 	seq    uint32
+	weight int    // weight of the stream, see Stream.SetWeight
+	finish uint64 // virtual finish time, assigned by shaperLoop
 	result chan writeResult
 }
 
@@ -49,6 +90,11 @@ type writeResult struct {
 // Session defines a multiplexed connection for streams
 type Session struct {
 	conn net.Conn
+	id   uint64
+
+	logger      *slog.Logger // nil if disabled
+	closeReason atomic.Value // closeReason, the first failure
+	goneOnce    sync.Once    // reports the end of the session
 
 	config           *Config
 	nextStreamID     uint32 // next stream identifier
@@ -56,6 +102,8 @@ type Session struct {
 
 	bucket       int32         // token bucket
 	bucketNotify chan struct{} // used for waiting for tokens
+	budget       *MemoryBudget // shared with other sessions, nil if none
+	budgetUsed   atomic.Int64  // bytes charged to the budget
 
 	streams    map[uint32]*Stream // all streams in this session
 	streamLock sync.Mutex         // locks streams
@@ -79,19 +127,71 @@ type Session struct {
 	chAccepts chan *Stream
 
 	dataReady int32 // flag data has arrived
+	probe     int32 // flag recvLoop may read one frame beyond the bucket
+
+	// round-trip ping
+	pingID   atomic.Uint64
+	pings    map[uint64]chan struct{}
+	pingLock sync.Mutex
+	srtt     atomic.Int64 // smoothed RTT in nanoseconds
 
 	goAway int32 // flag id exhausted
 
+	// version negotiation
+	ver           int32        // negotiated protocol version, 0 if not settled
+	negotiated    atomic.Value // Negotiation
+	chNegotiated  chan struct{}
+	chHelloSent   chan struct{} // closed once the own HELLO is out of the way
+	negotiateOnce sync.Once
+
+	// graceful shutdown
+	shutdown     int32         // flag local GOAWAY has been sent, guarded by streamLock
+	lastAccepted uint32        // last stream id accepted from remote, guarded by streamLock
+	remoteGoAway atomic.Value  // *GoAwayError received from remote
+	chGoAway     chan struct{} // closed when remote GOAWAY arrived
+	goAwayOnce   sync.Once
+
 	deadline atomic.Value
 
+	counters    sessionCounters
+	codec       *codec
+	sendLimiter *rateLimiter // bandwidth limits
+	recvLimiter *rateLimiter
+
+	// idle streams
+	janitorOnce sync.Once
+	chJanitor   chan struct{}
+	inflateBuf  []byte // used by recvLoop to decompress ZPSH
+
+	capture atomic.Pointer[CaptureWriter] // nil if disabled
+	peeked  []byte                        // payload read ahead for the capture, consumed by readFull
+
+	// messages
+	chMessages   chan []byte
+	msgSendLock  sync.Mutex    // serializes SendMessage
+	msgCredits   int32         // messages the peer accepts
+	chMsgCredits chan struct{} // signaled when credits are granted
+	msgConsumed  int32         // messages consumed, not yet granted back
+	msgGranted   int32         // flag the backlog past initial credits is granted
+
+	chControl chan Frame // control frames answering the peer, see sendControl
+
+	refusalLock sync.Mutex
+	refusals    map[uint32]refusal // streams to refuse, see refuseStream
+	chRefusals  chan struct{}      // signaled when a refusal is pending
+
 	requestID uint32            // write request monotonic increasing
 	shaper    chan writeRequest // a shaper for writing
-	writes    chan writeRequest
+	writes    chan []writeRequest
 
-	rwn sync.Mutex
-	prn int
-	wmu sync.Mutex
-	pwn int
+	rwn    sync.Mutex
+	prn    int
+	opener *frameOpener // AEAD of incoming frames, nil if disabled
+	wmu    sync.Mutex
+	pwn    int
+	sealer *frameSealer // AEAD of outgoing frames, nil if disabled
+
+	chSealerReady chan struct{} // closed once the sealer knows the peer's salt
 }
 
 func newSession(config *Config, conn net.Conn, client bool) *Session {
@@ -99,15 +199,46 @@ func newSession(config *Config, conn net.Conn, client bool) *Session {
 	s.die = make(chan struct{})
 	s.conn = conn
 	s.config = config
+	s.id = atomic.AddUint64(&sessionIDs, 1)
+	if config.Logger != nil {
+		s.logger = config.Logger.With("session", s.id)
+		s.logger.Info("smux session opened", "client", client, "remote", conn.RemoteAddr())
+	}
 	s.streams = make(map[uint32]*Stream)
-	s.chAccepts = make(chan *Stream, defaultAcceptBacklog)
+	backlog := defaultAcceptBacklog
+	if config.AcceptBacklog > 0 {
+		backlog = config.AcceptBacklog
+	}
+	s.chAccepts = make(chan *Stream, backlog)
 	s.bucket = int32(config.MaxReceiveBuffer)
 	s.bucketNotify = make(chan struct{}, 1)
+	if config.MemoryBudget != nil {
+		s.budget = config.MemoryBudget
+		s.budget.join()
+	}
 	s.shaper = make(chan writeRequest)
-	s.writes = make(chan writeRequest)
+	s.writes = make(chan []writeRequest)
 	s.chSocketReadError = make(chan struct{})
 	s.chSocketWriteError = make(chan struct{})
 	s.chProtoError = make(chan struct{})
+	s.chGoAway = make(chan struct{})
+	s.chNegotiated = make(chan struct{})
+	s.chHelloSent = make(chan struct{})
+	s.counters.created = time.Now()
+	s.pings = make(map[uint64]chan struct{})
+	s.codec = newCodec(config)
+	s.sendLimiter = newRateLimiter(config.SendRate)
+	s.recvLimiter = newRateLimiter(config.ReceiveRate)
+	s.chJanitor = make(chan struct{}, 1)
+	s.chMessages = make(chan []byte, s.messageBacklog())
+	s.msgCredits = initialMessageCredits
+	s.chMsgCredits = make(chan struct{}, 1)
+	s.chControl = make(chan Frame, controlBacklog)
+	s.refusals = make(map[uint32]refusal)
+	s.chRefusals = make(chan struct{}, 1)
+	if config.Capture != nil {
+		s.capture.Store(config.Capture)
+	}
 
 	if client {
 		s.nextStreamID = 1
@@ -115,12 +246,45 @@ func newSession(config *Config, conn net.Conn, client bool) *Session {
 		s.nextStreamID = 0
 	}
 
+	if len(config.Secret) != 0 {
+		maxPlain := headerSize + maxSmallFrameSize
+		if largeFramesEnabled(config) {
+			maxPlain = largeHeaderSize + maxLargeFrameSize
+		}
+		sealer, err := newFrameSealer(config, client)
+		if err != nil {
+			s.notifyWriteError(err)
+			sealer = &frameSealer{}
+		}
+		s.sealer = sealer
+		s.chSealerReady = make(chan struct{})
+		s.opener = newFrameOpener(config, !client, maxPlain, sealer.salt, func(peerSalt []byte) error {
+			if err := sealer.setPeerSalt(peerSalt); err != nil {
+				return err
+			}
+			close(s.chSealerReady)
+			return nil
+		})
+	}
+
+	if !config.Negotiate {
+		s.settle(Negotiation{Version: config.Version, Legacy: true})
+		close(s.chHelloSent)
+	}
+
 	go s.shaperLoop()
 	go s.recvLoop()
 	go s.sendLoop()
+	go s.controlLoop()
+	if config.Negotiate {
+		go s.negotiate()
+	}
 	if !config.KeepAliveDisabled {
 		go s.keepalive()
 	}
+	if config.StreamIdleTimeout > 0 {
+		s.startJanitor()
+	}
 	return s
 }
 
@@ -130,13 +294,43 @@ func (s *Session) Addr() net.Addr {
 
 // OpenStream is used to create a new stream
 func (s *Session) OpenStream() (*Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), openCloseTimeout)
+	defer cancel()
+	return s.OpenStreamContext(ctx, nil)
+}
+
+// OpenStreamContext is used to create a new stream carrying the metadata,
+// which the accepting side reads with Stream.Metadata. It gives up when ctx
+// is done before the SYN has been queued, once queued the SYN is sent and the
+// stream is returned, the peer is not left with a stream nobody closes.
+func (s *Session) OpenStreamContext(ctx context.Context, meta Metadata) (*Stream, error) {
 	if s.IsClosed() {
 		return nil, io.ErrClosedPipe
 	}
 
+	select {
+	case <-s.chGoAway:
+		return nil, s.remoteGoAway.Load().(*GoAwayError)
+	default:
+	}
+
+	if err := s.waitNegotiated(nil, ctx.Done(), ctx.Err); err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	if len(meta) != 0 {
+		if !s.peerSupports(FeatureMetadata) {
+			return nil, ErrNotSupported
+		}
+		if payload = meta.encode(); len(payload) > s.config.MaxFrameSize {
+			return nil, ErrMetadataTooLarge
+		}
+	}
+
 	// generate stream id
 	s.nextStreamIDLock.Lock()
-	if s.goAway > 0 {
+	if s.goAway > 0 || s.isShutdown() {
 		s.nextStreamIDLock.Unlock()
 		return nil, ErrGoAway
 	}
@@ -150,42 +344,66 @@ func (s *Session) OpenStream() (*Stream, error) {
 	}
 	s.nextStreamIDLock.Unlock()
 
-	stream := newStream(sid, s.config.MaxFrameSize, s)
-
-	if _, err := s.writeFrame(newFrame(byte(s.config.Version), cmdSYN, sid)); err != nil {
-		return nil, err
-	}
+	stream := newStream(sid, s.frameSize(), s)
+	stream.meta = maps.Clone(meta)
 
+	// registered before SYN is sent, the peer may answer at once
 	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
 	select {
 	case <-s.chSocketReadError:
+		s.streamLock.Unlock()
 		return nil, s.socketReadError.Load().(error)
 	case <-s.chSocketWriteError:
+		s.streamLock.Unlock()
 		return nil, s.socketWriteError.Load().(error)
 	case <-s.die:
+		s.streamLock.Unlock()
 		return nil, io.ErrClosedPipe
 	default:
+		if s.tooManyStreams() {
+			s.streamLock.Unlock()
+			return nil, ErrTooManyStreams
+		}
 		s.streams[sid] = stream
-		return stream, nil
 	}
+	s.streamLock.Unlock()
+
+	frame := newFrame(s.version(), cmdSYN, sid)
+	frame.data = payload
+	req, err := s.queueRequest(writeRequest{class: CLSCTRL, frame: frame}, nil, ctx.Done(), ctx.Err)
+	if err == nil {
+		_, err = s.waitRequest(req, nil, nil, nil)
+	}
+	if err != nil {
+		s.streamLock.Lock()
+		delete(s.streams, sid)
+		s.streamLock.Unlock()
+		return nil, err
+	}
+	s.streamOpened(stream, true)
+	return stream, nil
 }
 
 // AcceptStream is used to block until the next available stream
 // is ready to be accepted.
 func (s *Session) AcceptStream() (*Stream, error) {
-	var deadline <-chan time.Time
+	ctx := context.Background()
 	if d, ok := s.deadline.Load().(time.Time); ok && !d.IsZero() {
-		timer := time.NewTimer(time.Until(d))
-		defer timer.Stop()
-		deadline = timer.C
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d)
+		defer cancel()
 	}
+	return s.AcceptStreamContext(ctx)
+}
 
+// AcceptStreamContext is used to block until the next available stream
+// is ready to be accepted, or ctx is done.
+func (s *Session) AcceptStreamContext(ctx context.Context) (*Stream, error) {
 	select {
 	case stream := <-s.chAccepts:
 		return stream, nil
-	case <-deadline:
-		return nil, context.DeadlineExceeded
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-s.chSocketReadError:
 		return nil, s.socketReadError.Load().(error)
 	case <-s.chProtoError:
@@ -218,18 +436,88 @@ func (s *Session) Close() error {
 			c.sessionClose()
 		}
 		s.streamLock.Unlock()
-		return s.conn.Close()
+		err := s.conn.Close()
+		s.sessionGone()
+		return err
 	} else {
 		return io.ErrClosedPipe
 	}
 }
 
+// Shutdown gracefully drains the session. A GOAWAY is sent to the remote peer
+// so that it stops opening streams, further SYNs from the peer are rejected,
+// then Shutdown waits for all in-flight streams to be closed before closing
+// the session. If ctx expires first, the session is closed forcibly and the
+// context's error is returned. A peer without negotiation doesn't understand
+// GOAWAY, its SYNs are rejected only.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.streamLock.Lock()
+	first := atomic.CompareAndSwapInt32(&s.shutdown, 0, 1)
+	lastAccepted := s.lastAccepted
+	s.streamLock.Unlock()
+
+	if first {
+		if err := s.waitNegotiated(nil, ctx.Done(), ctx.Err); err != nil {
+			_ = s.Close()
+			return err
+		}
+		if s.peerExtended() {
+			frame := newFrame(s.version(), cmdGOAWAY, 0)
+			frame.data = make([]byte, szCmdGOAWAY)
+			binary.LittleEndian.PutUint32(frame.data, lastAccepted)
+			if _, err := s.writeFrameContext(ctx, frame); err != nil {
+				_ = s.Close()
+				return err
+			}
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.NumStreams() == 0 {
+			if err := s.Close(); err != io.ErrClosedPipe {
+				return err
+			}
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			_ = s.Close()
+			return ctx.Err()
+		case <-s.die:
+			return nil
+		}
+	}
+}
+
 // CloseChan can be used by someone who wants to be notified immediately when this
 // session is closed
 func (s *Session) CloseChan() <-chan struct{} {
 	return s.die
 }
 
+// GoAwayChan can be used by someone who wants to be notified immediately when
+// the remote peer starts draining this session, OpenStream fails with
+// *GoAwayError since then.
+func (s *Session) GoAwayChan() <-chan struct{} {
+	return s.chGoAway
+}
+
+// isShutdown checks if Shutdown has been called on this session
+func (s *Session) isShutdown() bool {
+	return atomic.LoadInt32(&s.shutdown) != 0
+}
+
+func (s *Session) notifyGoAway(lastStreamID uint32) {
+	s.goAwayOnce.Do(func() {
+		s.remoteGoAway.Store(&GoAwayError{LastStreamID: lastStreamID})
+		close(s.chGoAway)
+	})
+}
+
 // notifyBucket notifies recvLoop that bucket is available
 func (s *Session) notifyBucket() {
 	select {
@@ -239,24 +527,43 @@ func (s *Session) notifyBucket() {
 }
 
 func (s *Session) notifyReadError(err error) {
+	if !s.IsClosed() {
+		s.setCloseReason(err)
+	}
 	s.socketReadErrorOnce.Do(func() {
 		s.socketReadError.Store(err)
 		close(s.chSocketReadError)
 	})
+	s.sessionGone()
 }
 
 func (s *Session) notifyWriteError(err error) {
+	if !s.IsClosed() {
+		s.setCloseReason(err)
+	}
 	s.socketWriteErrorOnce.Do(func() {
 		s.socketWriteError.Store(err)
 		close(s.chSocketWriteError)
 	})
+	s.sessionGone()
+}
+
+// notifyReadFailure classifies the error returned by readFull
+func (s *Session) notifyReadFailure(err error) {
+	if errors.Is(err, ErrInvalidProtocol) {
+		s.notifyProtoError(err)
+	} else {
+		s.notifyReadError(err)
+	}
 }
 
 func (s *Session) notifyProtoError(err error) {
+	s.setCloseReason(err)
 	s.protoErrorOnce.Do(func() {
 		s.protoError.Store(err)
 		close(s.chProtoError)
 	})
+	s.sessionGone()
 }
 
 // IsClosed does a safe check to see if we have shutdown
@@ -299,17 +606,25 @@ func (s *Session) RemoteAddr() net.Addr {
 // notify the session that a stream has closed
 func (s *Session) streamClosed(sid uint32) {
 	s.streamLock.Lock()
-	if n := s.streams[sid].recycleTokens(); n > 0 { // return remaining tokens to the bucket
-		if atomic.AddInt32(&s.bucket, int32(n)) > 0 {
-			s.notifyBucket()
-		}
+	stream, ok := s.streams[sid]
+	if !ok {
+		s.streamLock.Unlock()
+		return
+	}
+	if n := stream.recycleTokens(); n > 0 { // return remaining tokens to the bucket
+		s.returnTokens(n)
 	}
 	delete(s.streams, sid)
 	s.streamLock.Unlock()
+
+	s.streamGone(stream, stream.resetError())
 }
 
 // returnTokens is called by stream to return token after read
 func (s *Session) returnTokens(n int) {
+	if s.budget != nil {
+		s.budget.release(s, n)
+	}
 	if atomic.AddInt32(&s.bucket, int32(n)) > 0 {
 		s.notifyBucket()
 	}
@@ -321,7 +636,10 @@ func (s *Session) recvLoop() {
 	var updHdr updHeader
 
 	for {
-		for atomic.LoadInt32(&s.bucket) <= 0 && !s.IsClosed() {
+		for !s.receiveReady() && !s.IsClosed() {
+			if atomic.CompareAndSwapInt32(&s.probe, 1, 0) {
+				break
+			}
 			select {
 			case <-s.bucketNotify:
 			case <-s.die:
@@ -330,31 +648,96 @@ func (s *Session) recvLoop() {
 		}
 
 		// read header first
-		if _, err := s.readFull(hdr[:]); err != nil {
-			s.notifyReadError(err)
+		if _, err := s.readFull(hdr[:headerSize]); err != nil {
+			s.notifyReadFailure(err)
+			break
+		}
+		if hdr.Version() >= largeFrameVersion {
+			if _, err := s.readFull(hdr[headerSize:]); err != nil {
+				s.notifyReadFailure(err)
+				break
+			}
+		} else {
+			hdr[headerSize], hdr[headerSize+1] = 0, 0
+		}
+		// checked before anything is waited for or read ahead
+		if !hdr.validLength() {
+			// the payload would be misread as the next frame
+			s.notifyProtoError(fmt.Errorf("%w: bad length %d of cmd %d", ErrInvalidProtocol, hdr.Length(), hdr.Cmd()))
 			break
 		}
 
 		atomic.StoreInt32(&s.dataReady, 1)
-		if hdr.Version() != byte(s.config.Version) {
+		s.counters.countReceived(hdr.Cmd(), headerLen(hdr.Version())+int(hdr.Length()))
+		if c := s.capture.Load(); c != nil {
+			if err := s.captureReceived(c, hdr); err != nil {
+				s.notifyReadFailure(err)
+				break
+			}
+		}
+		if err := s.recvLimiter.wait(headerLen(hdr.Version())+int(hdr.Length()), nil, s.die); err != nil {
+			return
+		}
+		sid := hdr.StreamID()
+		if hdr.Cmd() == cmdNOP && s.config.Negotiate && isHello(sid) {
+			if err := s.onHello(sid); err != nil {
+				s.notifyProtoError(err)
+				break
+			}
+			continue
+		}
+
+		if !s.settled() && hdr.Cmd() != cmdNOP {
+			// the peer speaks without HELLO
+			s.settle(Negotiation{Version: s.config.Version, Legacy: true})
+		}
+		// NOP may be sent with Config.Version before negotiation completes
+		if hdr.Version() != s.version() && (hdr.Cmd() != cmdNOP || hdr.Version() != byte(s.config.Version)) {
 			s.notifyProtoError(ErrInvalidProtocol)
 			break
 		}
 
-		sid := hdr.StreamID()
 		switch hdr.Cmd() {
 		case cmdNOP:
 		case cmdSYN:
-			s.streamLock.Lock()
-			if _, ok := s.streams[sid]; !ok {
-				stream := newStream(sid, s.config.MaxFrameSize, s)
-				s.streams[sid] = stream
-				select {
-				case s.chAccepts <- stream:
-				case <-s.die:
+			var meta Metadata
+			if hdr.Length() > 0 {
+				payload := make([]byte, hdr.Length())
+				if _, err := s.readFull(payload); err != nil {
+					s.notifyReadFailure(err)
+					return
+				}
+				var err error
+				if meta, err = decodeMetadata(payload); err != nil {
+					s.notifyProtoError(err)
+					return
 				}
 			}
+
+			var accepted *Stream
+			s.streamLock.Lock()
+			if s.isShutdown() {
+				s.refuseStream(sid, CodeRefused, "session is going away")
+			} else if _, ok := s.streams[sid]; ok {
+				// duplicated SYN
+			} else if s.tooManyStreams() {
+				s.refuseStream(sid, CodeTooManyStreams, "too many streams")
+			} else if len(s.chAccepts) == cap(s.chAccepts) {
+				// never block recvLoop on a full backlog
+				s.refuseStream(sid, CodeTooManyStreams, "accept backlog full")
+			} else {
+				accepted = newStream(sid, s.frameSize(), s)
+				accepted.meta = meta
+				s.lastAccepted = sid
+				s.streams[sid] = accepted
+			}
 			s.streamLock.Unlock()
+			if accepted != nil {
+				// published after OnStreamOpen, only recvLoop pushes thus
+				// the room checked above is still there
+				s.streamOpened(accepted, false)
+				s.chAccepts <- accepted
+			}
 		case cmdFIN:
 			s.streamLock.Lock()
 			if stream, ok := s.streams[sid]; ok {
@@ -362,24 +745,92 @@ func (s *Session) recvLoop() {
 				stream.notifyReadEvent()
 			}
 			s.streamLock.Unlock()
-		case cmdPSH:
+		case cmdGOAWAY:
+			var goAwayHdr [szCmdGOAWAY]byte
+			if _, err := s.readFull(goAwayHdr[:]); err == nil {
+				s.notifyGoAway(binary.LittleEndian.Uint32(goAwayHdr[:]))
+			} else {
+				s.notifyReadFailure(err)
+				return
+			}
+		case cmdPING, cmdPONG:
+			var pingHdr [szCmdPING]byte
+			if _, err := s.readFull(pingHdr[:]); err == nil {
+				if hdr.Cmd() == cmdPING {
+					s.onPing(pingHdr[:])
+				} else {
+					s.onPong(pingHdr[:])
+				}
+			} else {
+				s.notifyReadFailure(err)
+				return
+			}
+		case cmdRST:
+			if hdr.Length() < szCmdRST || hdr.Length() > szCmdRST+maxResetReason {
+				s.notifyProtoError(ErrInvalidProtocol)
+				return
+			}
+			payload := make([]byte, hdr.Length())
+			if _, err := s.readFull(payload); err != nil {
+				s.notifyReadFailure(err)
+				return
+			}
+			s.streamLock.Lock()
+			if stream, ok := s.streams[sid]; ok {
+				stream.reset(ErrorCode(binary.LittleEndian.Uint32(payload)), string(payload[szCmdRST:]))
+			}
+			s.streamLock.Unlock()
+		case cmdSTOP:
+			s.streamLock.Lock()
+			if stream, ok := s.streams[sid]; ok {
+				stream.stop()
+			}
+			s.streamLock.Unlock()
+		case cmdPSH, cmdZPSH:
 			if hdr.Length() == 0 {
 				continue
 			}
 
 			newbuf := defaultAllocator.Get(int(hdr.Length()))
 			if written, err := s.readFull(newbuf); err == nil {
+				if hdr.Cmd() == cmdZPSH {
+					if newbuf, err = s.inflate(newbuf); err != nil {
+						s.notifyProtoError(err)
+						return
+					}
+					written = len(newbuf)
+				}
+
 				s.streamLock.Lock()
-				if stream, ok := s.streams[sid]; ok {
+				if stream, ok := s.streams[sid]; ok && !stream.readClosed() && stream.resetError() == nil {
+					stream.counters.bytesIn.Add(uint64(written))
 					stream.pushBytes(newbuf)
-					atomic.AddInt32(&s.bucket, -int32(written))
+					s.takeTokens(written)
 					stream.notifyReadEvent()
+				} else {
+					// nobody will read it, recycle at once
+					defaultAllocator.Put(newbuf)
+					if ok && stream.readClosed() {
+						stream.discardWindow(written)
+					}
 				}
 				s.streamLock.Unlock()
 			} else {
-				s.notifyReadError(err)
+				s.notifyReadFailure(err)
+				return
+			}
+		case cmdMSG:
+			if err := s.readMessage(int(hdr.Length())); err != nil {
+				s.notifyReadFailure(err)
 				return
 			}
+		case cmdMUPD:
+			var credits [szCmdMUPD]byte
+			if _, err := s.readFull(credits[:]); err != nil {
+				s.notifyReadFailure(err)
+				return
+			}
+			s.onMessageCredits(binary.LittleEndian.Uint32(credits[:]))
 		case cmdUPD:
 			if _, err := s.readFull(updHdr[:]); err == nil {
 				s.streamLock.Lock()
@@ -388,7 +839,7 @@ func (s *Session) recvLoop() {
 				}
 				s.streamLock.Unlock()
 			} else {
-				s.notifyReadError(err)
+				s.notifyReadFailure(err)
 				return
 			}
 		default:
@@ -406,13 +857,20 @@ func (s *Session) keepalive() {
 	for {
 		select {
 		case <-tickerPing.C:
-			s.writeFrameInternal(newFrame(byte(s.config.Version), cmdNOP, 0), tickerPing.C, CLSCTRL)
+			if s.keepalivePingEnabled() {
+				go s.keepalivePing()
+			} else {
+				s.writeFrameInternal(newFrame(s.version(), cmdNOP, 0), tickerPing.C, CLSCTRL)
+			}
+			s.counters.keepAliveSent.Store(time.Now().UnixNano())
 			s.notifyBucket() // force a signal to the recvLoop
 		case <-tickerTimeout.C:
 			if !atomic.CompareAndSwapInt32(&s.dataReady, 1, 0) {
-				// recvLoop may block while bucket is 0, in this case,
-				// session should not be closed.
-				if atomic.LoadInt32(&s.bucket) > 0 {
+				// recvLoop may block while bucket is 0, or the budget
+				// exhausted, in this case, session should not be closed,
+				// unless it has been probed.
+				if !s.receivePaused() || s.keepalivePingEnabled() {
+					s.setCloseReason(ErrKeepAliveTimeout)
 					s.Close()
 					return
 				}
@@ -423,18 +881,63 @@ func (s *Session) keepalive() {
 	}
 }
 
+// keepalivePingEnabled checks if keepalive probes with PING
+func (s *Session) keepalivePingEnabled() bool {
+	return s.config.KeepAlivePing && s.settled() && s.peerSupports(FeaturePing)
+}
+
+// sendControl queues a control frame answering the peer without blocking
+// recvLoop, the frame is dropped if the queue is full, so a peer flooding
+// the session can't pile up goroutines or memory.
+func (s *Session) sendControl(frame Frame) bool {
+	select {
+	case s.chControl <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// controlLoop writes the control frames queued by sendControl
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case frame := <-s.chControl:
+			_, _ = s.writeFrame(frame)
+		case <-s.chRefusals:
+			s.sendRefusals()
+		case <-s.die:
+			return
+		}
+	}
+}
+
 // shaper shapes the sending sequence among streams
 func (s *Session) shaperLoop() {
 	var reqs shaperHeap
-	var next writeRequest
-	var chWrite chan writeRequest
+	var chWrite chan []writeRequest
 	var chShaper chan writeRequest
+	fair := newFairQueue()
+
+	// next is the batch offered to sendLoop, spare the one it wrote before,
+	// which it's done with once it takes next
+	next := make([]writeRequest, 0, sendBatchFrames)
+	spare := make([]writeRequest, 0, sendBatchFrames)
+	var nextSize int
 
 	for {
+		if len(next) == 0 {
+			nextSize = 0
+			for len(reqs) > 0 && len(next) < sendBatchFrames && nextSize < sendBatchBytes {
+				r := heap.Pop(&reqs).(writeRequest)
+				next = append(next, r)
+				nextSize += len(r.frame.data)
+			}
+		}
+
 		// chWrite is not available until it has packet to send
-		if len(reqs) > 0 {
+		if len(next) > 0 {
 			chWrite = s.writes
-			next = heap.Pop(&reqs).(writeRequest)
 		} else {
 			chWrite = nil
 		}
@@ -451,68 +954,120 @@ func (s *Session) shaperLoop() {
 			panic("both channel are nil")
 		}
 
+		s.counters.shaperQueue.Store(int32(len(reqs) + len(next)))
+
 		select {
 		case <-s.die:
 			return
 		case r := <-chShaper:
-			if chWrite != nil { // next is valid, reshape
-				heap.Push(&reqs, next)
+			fair.enqueue(&r)
+			switch {
+			case len(next) > 0 && sendsBefore(&r, &next[len(next)-1]):
+				// r goes before some of the batch, reshape
+				for _, req := range next {
+					heap.Push(&reqs, req)
+				}
+				clear(next)
+				next = next[:0]
+				heap.Push(&reqs, r)
+			case len(next) > 0 && len(reqs) == 0 && len(next) < sendBatchFrames && nextSize < sendBatchBytes:
+				next = append(next, r)
+				nextSize += len(r.frame.data)
+			default:
+				heap.Push(&reqs, r)
 			}
-			heap.Push(&reqs, r)
 		case chWrite <- next:
+			for i := range next {
+				fair.dequeue(&next[i])
+			}
+			next, spare = spare[:0], next
 		}
 	}
 }
 
 func (s *Session) sendLoop() {
-	var buf []byte
-	var n int
-	var err error
+	var buf []byte   // frames of the batch, coalesced
+	var plain []byte // frame to seal
+	var hdrs []byte  // headers of the batch for vectored writes
 	var vec [][]byte // vector for writeBuffers
+	var err error
 
 	bw, ok := s.conn.(interface {
 		WriteBuffers(v [][]byte) (n int, err error)
 	})
 
-	if ok {
-		buf = make([]byte, headerSize)
-		vec = make([][]byte, 2)
+	// the salts are exchanged ahead of the records
+	if s.sealer != nil {
+		if _, err := s.write(s.sealer.salt); err != nil {
+			s.notifyWriteError(err)
+			return
+		}
+	}
+	sealerReady := s.chSealerReady
+
+	// frames must go through s.write to be protected
+	vectored := (ok || writevConn(s.conn)) && len(s.config.Passwd) == 0 && s.sealer == nil
+	if vectored {
+		hdrs = make([]byte, 0, sendBatchFrames*largeHeaderSize)
+		vec = make([][]byte, 0, 2*sendBatchFrames)
 	} else {
-		buf = make([]byte, (1<<16)+headerSize)
+		buf = make([]byte, 0, (1<<16)+largeHeaderSize)
 	}
 
 	for {
 		select {
 		case <-s.die:
 			return
-		case request := <-s.writes:
-			buf[0] = request.frame.ver
-			buf[1] = request.frame.cmd
-			binary.LittleEndian.PutUint16(buf[2:], uint16(len(request.frame.data)))
-			binary.LittleEndian.PutUint32(buf[4:], request.frame.sid)
-
-			if len(vec) > 0 {
-				vec[0] = buf[:headerSize]
-				vec[1] = request.frame.data
-				n, err = bw.WriteBuffers(vec)
-			} else {
-				copy(buf[headerSize:], request.frame.data)
-				// n, err = s.conn.Write(buf[:headerSize+len(request.frame.data)])
-				n, err = s.write(buf[:headerSize+len(request.frame.data)])
-			}
-
-			n -= headerSize
-			if n < 0 {
-				n = 0
+		case batch := <-s.writes:
+			if vectored {
+				// hdrs is large enough for the batch, never reallocated
+				hdrs = hdrs[:0]
+				for i := range batch {
+					f := &batch[i].frame
+					off := len(hdrs)
+					hdrs = appendHeader(hdrs, f.ver, f.cmd, len(f.data), f.sid)
+					vec = append(vec, hdrs[off:], f.data)
+				}
+				if ok {
+					_, err = bw.WriteBuffers(vec)
+				} else {
+					bufs := net.Buffers(vec)
+					_, err = bufs.WriteTo(s.conn)
+				}
+				clear(vec[:cap(vec)]) // don't pin the frames
+				vec = vec[:0]
+			} else if err = s.waitSealer(sealerReady); err == nil {
+				sealerReady = nil
+				buf = buf[:0]
+				for i := range batch {
+					f := &batch[i].frame
+					if s.sealer != nil {
+						// one record per frame, within the peer's limit
+						plain = appendHeader(plain[:0], f.ver, f.cmd, len(f.data), f.sid)
+						plain = append(plain, f.data...)
+						buf = s.sealer.seal(buf, plain)
+					} else {
+						buf = appendHeader(buf, f.ver, f.cmd, len(f.data), f.sid)
+						buf = append(buf, f.data...)
+					}
+				}
+				_, err = s.write(buf)
 			}
 
-			result := writeResult{
-				n:   n,
-				err: err,
+			for i := range batch {
+				request := &batch[i]
+				result := writeResult{err: err}
+				if err == nil {
+					result.n = len(request.frame.data)
+					s.counters.countSent(request.frame.cmd, headerLen(request.frame.ver)+len(request.frame.data))
+					if c := s.capture.Load(); c != nil {
+						s.captureSent(c, &request.frame)
+					}
+				}
+				request.result <- result
+				close(request.result)
 			}
-
-			request.result <- result
-			close(request.result)
+			clear(batch)
 
 			// store conn error
 			if err != nil {
@@ -523,30 +1078,88 @@ func (s *Session) sendLoop() {
 	}
 }
 
+// waitSealer waits for recvLoop to read the peer's salt, ready is nil once it
+// has been read
+func (s *Session) waitSealer(ready <-chan struct{}) error {
+	if ready == nil {
+		return nil
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-s.die:
+		return io.ErrClosedPipe
+	case <-s.chSocketReadError:
+		return s.socketReadError.Load().(error)
+	case <-s.chProtoError:
+		return s.protoError.Load().(error)
+	}
+}
+
+// writevConn checks if net.Buffers are written to conn with a single
+// writev system call
+func writevConn(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
 // writeFrame writes the frame to the underlying connection
 // and returns the number of bytes written if successful
 func (s *Session) writeFrame(f Frame) (n int, err error) {
 	return s.writeFrameInternal(f, time.After(openCloseTimeout), CLSCTRL)
 }
 
+// writeFrameContext writes a control frame, it returns when ctx is done
+func (s *Session) writeFrameContext(ctx context.Context, f Frame) (int, error) {
+	req := writeRequest{class: CLSCTRL, frame: f}
+	return s.writeRequestCancel(req, nil, ctx.Done(), ctx.Err)
+}
+
 // internal writeFrame version to support deadline used in keepalive
 func (s *Session) writeFrameInternal(f Frame, deadline <-chan time.Time, class CLASSID) (int, error) {
-	req := writeRequest{
-		class:  class,
-		frame:  f,
-		seq:    atomic.AddUint32(&s.requestID, 1),
-		result: make(chan writeResult, 1),
+	req := writeRequest{class: class, frame: f}
+	return s.writeRequestCancel(req, deadline, nil, nil)
+}
+
+// writeRequestCancel queues the request to the shaper and waits for the result,
+// it gives up when either deadline fires or cancel is closed, in which case
+// cause reports the error of cancel.
+func (s *Session) writeRequestCancel(req writeRequest, deadline <-chan time.Time, cancel <-chan struct{}, cause func() error) (int, error) {
+	req, err := s.queueRequest(req, deadline, cancel, cause)
+	if err != nil {
+		return 0, err
+	}
+	return s.waitRequest(req, deadline, cancel, cause)
+}
+
+// queueRequest hands the request to the shaper, once queued the frame is
+// written even if the caller stops waiting for it
+func (s *Session) queueRequest(req writeRequest, deadline <-chan time.Time, cancel <-chan struct{}, cause func() error) (writeRequest, error) {
+	req.seq = atomic.AddUint32(&s.requestID, 1)
+	req.result = make(chan writeResult, 1)
+	if req.weight <= 0 {
+		req.weight = DefaultStreamWeight
 	}
+
 	select {
 	case s.shaper <- req:
+		return req, nil
 	case <-s.die:
-		return 0, io.ErrClosedPipe
+		return req, io.ErrClosedPipe
 	case <-s.chSocketWriteError:
-		return 0, s.socketWriteError.Load().(error)
+		return req, s.socketWriteError.Load().(error)
 	case <-deadline:
-		return 0, context.DeadlineExceeded
+		return req, context.DeadlineExceeded
+	case <-cancel:
+		return req, cause()
 	}
+}
 
+// waitRequest waits for the result of a queued request
+func (s *Session) waitRequest(req writeRequest, deadline <-chan time.Time, cancel <-chan struct{}, cause func() error) (int, error) {
 	select {
 	case result := <-req.result:
 		return result.n, result.err
@@ -556,10 +1169,36 @@ func (s *Session) writeFrameInternal(f Frame, deadline <-chan time.Time, class C
 		return 0, s.socketWriteError.Load().(error)
 	case <-deadline:
 		return 0, context.DeadlineExceeded
+	case <-cancel:
+		return 0, cause()
 	}
 }
 
+// discard skips n bytes of payload for recvLoop
+func (s *Session) discard(n int) error {
+	buf := defaultAllocator.Get(min(n, maxSmallFrameSize))
+	defer defaultAllocator.Put(buf)
+	for n > 0 {
+		m, err := s.readFull(buf[:min(n, len(buf))])
+		if err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
 func (s *Session) readFull(b []byte) (int, error) {
+	if len(s.peeked) > 0 {
+		n := copy(b, s.peeked)
+		s.peeked = s.peeked[n:]
+		if n == len(b) {
+			return n, nil
+		}
+		m, err := s.readFull(b[n:])
+		return n + m, err
+	}
+
 	if du := s.config.ReadTimeout; du > 0 {
 		_ = s.conn.SetReadDeadline(time.Now().Add(du))
 	}
@@ -567,7 +1206,13 @@ func (s *Session) readFull(b []byte) (int, error) {
 	s.rwn.Lock()
 	defer s.rwn.Unlock()
 
-	n, err := io.ReadFull(s.conn, b)
+	var n int
+	var err error
+	if s.opener != nil {
+		n, err = s.opener.readFull(s.conn, b)
+	} else {
+		n, err = io.ReadFull(s.conn, b)
+	}
 	if err != nil || n == 0 {
 		// Session 实现了 net.Listener 接口，但是很多服务端对 Accept() 的临时错误做了指数退避处理，
 		// 例如标准库的 http.Server：https://github.com/golang/go/blob/master/src/net/http/server.go#L3061-L3073。
@@ -580,7 +1225,7 @@ func (s *Session) readFull(b []byte) (int, error) {
 		return 0, err
 	}
 	passwd := s.config.Passwd
-	if psz := len(passwd); psz != 0 {
+	if psz := len(passwd); psz != 0 && s.opener == nil {
 		prn := s.prn
 		for i, dat := range b {
 			prn = (prn + 1) % psz
@@ -598,7 +1243,7 @@ func (s *Session) write(dats []byte) (int, error) {
 	defer s.wmu.Unlock()
 
 	passwd := s.config.Passwd
-	if psz := len(passwd); psz != 0 {
+	if psz := len(passwd); psz != 0 && s.sealer == nil {
 		pwn := s.pwn
 		for i, dat := range dats {
 			pwn = (pwn + 1) % psz
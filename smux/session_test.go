@@ -0,0 +1,1072 @@
+package smux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// newSessionPair creates a connected client/server session pair over an in-memory pipe.
+func newSessionPair(t *testing.T, config *Config) (*Session, *Session) {
+	t.Helper()
+
+	if config == nil {
+		config = DefaultConfig()
+		config.Negotiate = true
+	}
+	a, b := net.Pipe()
+	cli := Client(a, config)
+	srv := Server(b, config)
+	t.Cleanup(func() {
+		_ = cli.Close()
+		_ = srv.Close()
+	})
+
+	return cli, srv
+}
+
+// openPair opens a stream on the client and accepts it on the server.
+func openPair(t *testing.T, cli, srv *Session) (*Stream, *Stream) {
+	t.Helper()
+
+	local, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	remote, err := srv.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return local, remote
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		config := DefaultConfig()
+		config.Version = version
+		cli, srv := newSessionPair(t, config)
+		local, remote := openPair(t, cli, srv)
+
+		go func() {
+			// echo until EOF, then close
+			_, _ = io.Copy(remote, remote)
+			_ = remote.Close()
+		}()
+
+		msg := []byte("hello half-close")
+		if _, err := local.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := local.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := local.Write(msg); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("v%d: write after CloseWrite: %v", version, err)
+		}
+
+		_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(local)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("v%d: got %q, want %q", version, got, msg)
+		}
+		if err = local.Close(); err != nil {
+			t.Fatalf("v%d: close after CloseWrite: %v", version, err)
+		}
+	}
+}
+
+func TestStreamCloseWriteLargeReply(t *testing.T) {
+	legacy := DefaultConfig()
+	legacy.Version = 2
+	config := DefaultConfig()
+	config.Negotiate = true
+	for _, config := range []*Config{legacy, config} {
+		cli, srv := newSessionPair(t, config)
+		local, remote := openPair(t, cli, srv)
+
+		// the reply outgrows the window, the peer keeps on reading after FIN
+		reply := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+		written := make(chan error, 1)
+		go func() {
+			_, _ = io.Copy(io.Discard, remote)
+			n, err := remote.Write(reply)
+			if err == nil && n != len(reply) {
+				err = fmt.Errorf("wrote %d bytes", n)
+			}
+			written <- err
+		}()
+
+		if _, err := local.Write([]byte("request")); err != nil {
+			t.Fatal(err)
+		}
+		if err := local.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, len(reply))
+		if _, err := io.ReadFull(local, got); err != nil {
+			t.Fatalf("negotiate %t: %v", config.Negotiate, err)
+		}
+		if err := <-written; err != nil {
+			t.Fatalf("negotiate %t: %v", config.Negotiate, err)
+		}
+	}
+}
+
+func TestStreamCloseStopsWriter(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := remote.Write(make([]byte, 1<<20))
+		written <- err
+	}()
+	waitFor(t, "data to be buffered", func() bool {
+		local.bufferLock.Lock()
+		defer local.bufferLock.Unlock()
+		return len(local.buffers) > 0
+	})
+	_ = local.Close()
+	select {
+	case err := <-written:
+		if !errors.Is(err, ErrBrokenPipe) {
+			t.Fatalf("write after close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer blocked after close")
+	}
+}
+
+func TestStreamCloseRead(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+
+	if err := remote.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := remote.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Fatalf("read after CloseRead: %d, %v", n, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := local.Write([]byte("discarded"))
+		if errors.Is(err, ErrBrokenPipe) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("peer never observed STOP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the reverse direction is still usable
+	go func() { _, _ = remote.Write([]byte("pong")) }()
+	buf := make([]byte, 4)
+	_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read reverse direction: %q, %v", buf, err)
+	}
+}
+
+func TestStreamCloseReadLegacy(t *testing.T) {
+	config := DefaultConfig()
+	config.Version = 2
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+	if _, err := local.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "data to be buffered", func() bool {
+		remote.bufferLock.Lock()
+		defer remote.bufferLock.Unlock()
+		return len(remote.buffers) > 0
+	})
+	if err := remote.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer isn't told, the discarded data still opens its window
+	_ = local.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionShutdown(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case <-cli.GoAwayChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("GOAWAY not received")
+	}
+	_, err := cli.OpenStream()
+	var goAway *GoAwayError
+	if !errors.As(err, &goAway) || !errors.Is(err, ErrGoAway) {
+		t.Fatalf("open stream while draining: %v", err)
+	}
+	if goAway.LastStreamID != local.ID() {
+		t.Fatalf("last stream id %d, want %d", goAway.LastStreamID, local.ID())
+	}
+
+	// in-flight stream keeps working until closed
+	go func() { _, _ = remote.Write([]byte("bye")) }()
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(local, buf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("shutdown returned early: %v", err)
+	default:
+	}
+
+	_ = remote.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+}
+
+func TestSessionShutdownTimeout(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	openPair(t, cli, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if !srv.IsClosed() {
+		t.Fatal("session should be closed forcibly")
+	}
+}
+
+// tamperConn flips a bit of the n-th byte written.
+type tamperConn struct {
+	net.Conn
+	n int
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if c.n >= 0 && c.n < len(b) {
+		b = append([]byte(nil), b...)
+		b[c.n] ^= 0x01
+	}
+	c.n -= len(b)
+	return c.Conn.Write(b)
+}
+
+func TestSessionSecret(t *testing.T) {
+	// Passwd is ignored once frames are sealed
+	for _, passwd := range [][]byte{nil, []byte("passwd")} {
+		config := DefaultConfig()
+		config.Secret = []byte("shared secret")
+		config.Passwd = passwd
+		cli, srv := newSessionPair(t, config)
+		local, remote := openPair(t, cli, srv)
+
+		go func() { _, _ = io.Copy(remote, remote) }()
+		msg := bytes.Repeat([]byte("secret"), 10000)
+		go func() { _, _ = local.Write(msg) }()
+		got := make([]byte, len(msg))
+		_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(local, got); err != nil {
+			t.Fatalf("passwd %q: %v", passwd, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("passwd %q: data mismatch", passwd)
+		}
+	}
+}
+
+func TestSessionSecretTampered(t *testing.T) {
+	config := DefaultConfig()
+	config.Secret = []byte("shared secret")
+	a, b := net.Pipe()
+	// skip the salt and the record length of the first record
+	cli := Client(&tamperConn{Conn: a, n: sizeOfSalt + sizeOfRecordLength + 1}, config)
+	srv := Server(b, config)
+	defer cli.Close()
+	defer srv.Close()
+
+	_, _ = cli.OpenStream()
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.AcceptStream(); !errors.Is(err, ErrAuthFailed) || !errors.Is(err, ErrInvalidProtocol) {
+		t.Fatalf("accept tampered stream: %v", err)
+	}
+}
+
+// recordConn keeps a copy of the bytes written.
+type recordConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.buf.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestSessionSecretReplay(t *testing.T) {
+	config := DefaultConfig()
+	config.Secret = []byte("shared secret")
+	a, b := net.Pipe()
+	rec := &recordConn{Conn: a}
+	cli := Client(rec, config)
+	srv := Server(b, config)
+	defer cli.Close()
+	defer srv.Close()
+	local, remote := openPair(t, cli, srv)
+	go func() { _, _ = local.Write([]byte("recorded")) }()
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server of the replay picks another salt
+	rec.mu.Lock()
+	recorded := bytes.Clone(rec.buf.Bytes())
+	rec.mu.Unlock()
+	c, d := net.Pipe()
+	replayed := Server(d, config)
+	defer replayed.Close()
+	go func() { _, _ = io.Copy(io.Discard, c) }()
+	go func() { _, _ = c.Write(recorded) }()
+	_ = replayed.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := replayed.AcceptStream(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("accept replayed stream: %v", err)
+	}
+}
+
+func TestSessionSecretMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.Secret = []byte("secret a")
+	cli := Client(a, config)
+	config = DefaultConfig()
+	config.Secret = []byte("secret b")
+	srv := Server(b, config)
+	defer cli.Close()
+	defer srv.Close()
+
+	_, _ = cli.OpenStream()
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.AcceptStream(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("accept with wrong secret: %v", err)
+	}
+}
+
+func TestSessionNegotiate(t *testing.T) {
+	config := DefaultConfig()
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+
+	want := Negotiation{Version: 2, Features: FeaturePing | FeatureMetadata | FeatureReset | FeatureMessage}
+	if got := cli.Negotiated(); got != want {
+		t.Fatalf("client negotiated %v, want %v", got, want)
+	}
+	if got := srv.Negotiated(); got != want {
+		t.Fatalf("server negotiated %v, want %v", got, want)
+	}
+
+	go func() { _, _ = remote.Write([]byte("v2")) }()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionNegotiateLegacy(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.Negotiate = true
+	config.NegotiateTimeout = 200 * time.Millisecond
+	cli := Client(a, config)
+	srv := Server(b, DefaultConfig())
+	defer cli.Close()
+	defer srv.Close()
+
+	// the legacy server ignores HELLO and never answers
+	local, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cli.Negotiated(); got.Version != 1 || !got.Legacy {
+		t.Fatalf("negotiated with legacy peer: %v", got)
+	}
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	remote, err := srv.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.ID() != local.ID() {
+		t.Fatalf("accepted stream %d, want %d", remote.ID(), local.ID())
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+
+	msg := []byte("statistics")
+	if _, err := local.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := cli.Stats()
+	if psh := sent.SentByCmd["PSH"]; psh.Frames != 1 || psh.Bytes != uint64(headerSize+len(msg)) {
+		t.Fatalf("client PSH stats: %+v", psh)
+	}
+	if sent.Streams != 1 {
+		t.Fatalf("client streams: %d", sent.Streams)
+	}
+	received := srv.Stats()
+	if received.ReceivedByCmd["SYN"].Frames != 1 || received.ReceivedByCmd["PSH"].Frames != 1 {
+		t.Fatalf("server received stats: %+v", received.ReceivedByCmd)
+	}
+
+	if st := local.Stats(); st.BytesOut != uint64(len(msg)) || st.LastActivity.IsZero() {
+		t.Fatalf("local stream stats: %+v", st)
+	}
+	if st := remote.Stats(); st.BytesIn != uint64(len(msg)) || st.Buffered != 0 {
+		t.Fatalf("remote stream stats: %+v", st)
+	}
+}
+
+func TestSessionPing(t *testing.T) {
+	config := DefaultConfig()
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := cli.Ping(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Fatalf("rtt %s", rtt)
+		}
+	}
+	if cli.RTT() <= 0 || cli.Stats().RTT != cli.RTT() {
+		t.Fatalf("smoothed rtt %s", cli.RTT())
+	}
+	if n := srv.Stats().ReceivedByCmd["PING"].Frames; n != 3 {
+		t.Fatalf("server received %d pings", n)
+	}
+}
+
+func TestSessionPingLegacy(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.Negotiate = true
+	config.NegotiateTimeout = 100 * time.Millisecond
+	cli := Client(a, config)
+	srv := Server(b, DefaultConfig())
+	defer cli.Close()
+	defer srv.Close()
+
+	if _, err := cli.Ping(context.Background()); err != ErrNotSupported {
+		t.Fatalf("ping legacy peer: %v", err)
+	}
+}
+
+func TestSessionPingFlood(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.KeepAlivePing = true
+	srv := Server(b, config)
+	defer srv.Close()
+	defer a.Close()
+
+	// the peer never reads the PONGs, they pile up in the control queue
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10*controlBacklog; i++ {
+		frame := appendHeader(nil, 1, cmdPING, szCmdPING, 0)
+		frame = binary.LittleEndian.AppendUint64(frame, uint64(i))
+		if _, err := a.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine() - before; n > controlBacklog {
+		t.Fatalf("%d goroutines spawned by PINGs", n)
+	}
+	if srv.IsClosed() {
+		t.Fatal("session closed by PINGs")
+	}
+}
+
+func TestSessionLegacy(t *testing.T) {
+	cli, srv := newSessionPair(t, DefaultConfig())
+
+	if _, err := cli.Ping(context.Background()); err != ErrNotSupported {
+		t.Fatalf("ping: %v", err)
+	}
+	if err := cli.SendMessage(context.Background(), []byte("msg")); err != ErrNotSupported {
+		t.Fatalf("send message: %v", err)
+	}
+	if _, err := cli.OpenStreamContext(context.Background(), Metadata{"k": "v"}); err != ErrNotSupported {
+		t.Fatalf("open stream with metadata: %v", err)
+	}
+
+	// a stock smux peer only understands FIN
+	local, remote := openPair(t, cli, srv)
+	if err := local.Reset(CodeCancel, "legacy"); err != nil {
+		t.Fatal(err)
+	}
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after reset: %v", err)
+	}
+}
+
+func TestSessionKeepAlivePing(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepAliveDisabled = false
+	config.KeepAlivePing = true
+	config.KeepAliveInterval = 20 * time.Millisecond
+	config.KeepAliveTimeout = 200 * time.Millisecond
+	cli, _ := newSessionPair(t, config)
+
+	time.Sleep(500 * time.Millisecond)
+	if cli.IsClosed() {
+		t.Fatal("session closed while the peer is alive")
+	}
+	if cli.RTT() <= 0 {
+		t.Fatal("keepalive did not measure rtt")
+	}
+}
+
+func TestStreamMetadata(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+
+	meta := Metadata{"service": "shell", "trace-id": "4bf92f3577b34da6"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	local, err := cli.OpenStreamContext(ctx, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := srv.AcceptStreamContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.ID() != local.ID() {
+		t.Fatalf("accepted stream %d, want %d", remote.ID(), local.ID())
+	}
+	got := remote.Metadata()
+	if len(got) != len(meta) || got.Get("service") != "shell" || got.Get("trace-id") != meta["trace-id"] {
+		t.Fatalf("metadata %v, want %v", got, meta)
+	}
+
+	// streams without metadata still work
+	local, remote = openPair(t, cli, srv)
+	if local.Metadata() != nil || remote.Metadata() != nil {
+		t.Fatal("unexpected metadata")
+	}
+}
+
+func TestAcceptStreamContext(t *testing.T) {
+	_, srv := newSessionPair(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := srv.AcceptStreamContext(ctx); err != context.Canceled {
+		t.Fatalf("accept canceled: %v", err)
+	}
+}
+
+func TestOpenStreamContextQueued(t *testing.T) {
+	a, b := net.Pipe()
+	conn := &holdingConn{Conn: a}
+	cli := Client(conn, DefaultConfig())
+	srv := Server(b, DefaultConfig())
+	t.Cleanup(func() {
+		_ = cli.Close()
+		_ = srv.Close()
+	})
+
+	// canceled once the SYN is queued, the stream is opened all the same
+	hold := make(chan struct{})
+	conn.hold.Store(&hold)
+	ctx, cancel := context.WithCancel(context.Background())
+	opened := make(chan error, 1)
+	go func() {
+		_, err := cli.OpenStreamContext(ctx, nil)
+		opened <- err
+	}()
+	waitFor(t, "the SYN to be held", conn.held.Load)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	conn.hold.Store(nil)
+	close(hold)
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	if n := cli.NumStreams(); n != 1 {
+		t.Fatalf("%d streams", n)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		config := DefaultConfig()
+		config.Version = version
+		config.Negotiate = true
+		cli, srv := newSessionPair(t, config)
+		local, remote := openPair(t, cli, srv)
+
+		chErr := make(chan error, 1)
+		go func() {
+			_, err := remote.Read(make([]byte, 16))
+			chErr <- err
+		}()
+		if err := local.Reset(CodeConnectFailed, "dial tcp 10.0.0.1:22: connection refused"); err != nil {
+			t.Fatal(err)
+		}
+
+		var serr *StreamError
+		select {
+		case err := <-chErr:
+			if !errors.As(err, &serr) {
+				t.Fatalf("v%d: read after reset: %v", version, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d: read not interrupted by RST", version)
+		}
+		if !serr.Remote || serr.Code != CodeConnectFailed || serr.StreamID != remote.ID() || serr.Reason == "" {
+			t.Fatalf("v%d: remote error %+v", version, serr)
+		}
+		if _, err := remote.Write([]byte("x")); !errors.As(err, &serr) {
+			t.Fatalf("v%d: write after reset: %v", version, err)
+		}
+		if _, err := local.Read(make([]byte, 1)); !errors.As(err, &serr) || serr.Remote {
+			t.Fatalf("v%d: local read after reset: %v", version, err)
+		}
+		if err := remote.Close(); err != nil {
+			t.Fatalf("v%d: close after reset: %v", version, err)
+		}
+	}
+}
+
+func TestStreamResetLongReason(t *testing.T) {
+	cli, srv := newSessionPair(t, nil)
+	local, remote := openPair(t, cli, srv)
+
+	// truncated at a rune boundary
+	if err := local.Reset(CodeCancel, "x"+strings.Repeat("é", maxResetReason)); err != nil {
+		t.Fatal(err)
+	}
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var serr *StreamError
+	if _, err := remote.Read(make([]byte, 1)); !errors.As(err, &serr) {
+		t.Fatalf("read after reset: %v", err)
+	}
+	if len(serr.Reason) > maxResetReason || !utf8.ValidString(serr.Reason) {
+		t.Fatalf("reason of %d bytes, valid %t", len(serr.Reason), utf8.ValidString(serr.Reason))
+	}
+}
+
+func TestShutdownRefusesStream(t *testing.T) {
+	config := DefaultConfig()
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+	openPair(t, cli, srv)
+
+	go func() { _ = srv.Shutdown(context.Background()) }()
+	for !srv.isShutdown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// open before GOAWAY arrives by writing the SYN directly
+	cli.nextStreamIDLock.Lock()
+	cli.nextStreamID += 2
+	sid := cli.nextStreamID
+	cli.nextStreamIDLock.Unlock()
+	stream := newStream(sid, config.MaxFrameSize, cli)
+	cli.streamLock.Lock()
+	cli.streams[sid] = stream
+	cli.streamLock.Unlock()
+	if _, err := cli.writeFrame(newFrame(cli.version(), cmdSYN, sid)); err != nil {
+		t.Fatal(err)
+	}
+
+	var serr *StreamError
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); !errors.As(err, &serr) || serr.Code != CodeRefused {
+		t.Fatalf("read refused stream: %v", err)
+	}
+}
+
+func TestSessionCompression(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		config := DefaultConfig()
+		config.Version = version
+		config.Compression = true
+		cli, srv := newSessionPair(t, config)
+		local, remote := openPair(t, cli, srv)
+
+		msg := bytes.Repeat([]byte(`{"level":"info","msg":"task finished","id":42}`+"\n"), 2000)
+		written := make(chan struct{})
+		go func() {
+			_, _ = local.Write(msg)
+			close(written)
+		}()
+		got := make([]byte, len(msg))
+		_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(remote, got); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		<-written
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("v%d: data mismatch", version)
+		}
+
+		sent := cli.Stats().CompressionSent
+		if sent.Raw != uint64(len(msg)) || sent.Ratio() >= 0.5 {
+			t.Fatalf("v%d: compression sent %+v", version, sent)
+		}
+		if received := srv.Stats().CompressionReceived; received != sent {
+			t.Fatalf("v%d: compression received %+v, sent %+v", version, received, sent)
+		}
+		if st := local.Stats(); st.BytesOut != uint64(len(msg)) {
+			t.Fatalf("v%d: bytes out %d", version, st.BytesOut)
+		}
+
+		// skipped per stream
+		local.SetCompression(false)
+		go func() { _, _ = local.Write(msg) }()
+		if _, err := io.ReadFull(remote, got); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if cli.Stats().CompressionSent != sent {
+			t.Fatalf("v%d: stream compressed with compression off", version)
+		}
+	}
+}
+
+func TestMaxStreamsFlood(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.MaxStreams = 1
+	srv := Server(b, config)
+	defer srv.Close()
+	defer a.Close()
+
+	// the peer never reads the refusals, they pile up until refusalBacklog
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10*controlBacklog; i++ {
+		if _, err := a.Write(appendHeader(nil, 1, cmdSYN, 0, uint32(2*i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine() - before; n > controlBacklog {
+		t.Fatalf("%d goroutines spawned by SYNs", n)
+	}
+	if srv.IsClosed() {
+		t.Fatal("session closed by SYNs")
+	}
+}
+
+func TestMaxStreamsBurst(t *testing.T) {
+	srvConfig := DefaultConfig()
+	srvConfig.Negotiate = true
+	srvConfig.MaxStreams = 1
+	cliConfig := DefaultConfig()
+	cliConfig.Negotiate = true
+	a, b := net.Pipe()
+	conn := &holdingConn{Conn: b}
+	cli := Client(a, cliConfig)
+	srv := Server(conn, srvConfig)
+	defer cli.Close()
+	defer srv.Close()
+	if _, err := cli.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every stream refused in a burst is told so, even if the refusals
+	// can't be written as fast as the SYNs arrive
+	hold := make(chan struct{})
+	conn.hold.Store(&hold)
+	var streams []*Stream
+	for i := 0; i < 4*controlBacklog; i++ {
+		stream, err := cli.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	waitFor(t, "the SYNs to be received", func() bool {
+		return srv.Stats().ReceivedByCmd["SYN"].Frames == uint64(len(streams)+1)
+	})
+	conn.hold.Store(nil)
+	close(hold)
+	for _, stream := range streams {
+		_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrTooManyStreams) {
+			t.Fatalf("stream %d: expected ErrTooManyStreams, got %v", stream.ID(), err)
+		}
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	for name, config := range map[string]*Config{
+		"max streams":    {MaxStreams: 2},
+		"accept backlog": {AcceptBacklog: 2},
+	} {
+		srvConfig := DefaultConfig()
+		srvConfig.Negotiate = true
+		srvConfig.MaxStreams, srvConfig.AcceptBacklog = config.MaxStreams, config.AcceptBacklog
+		cliConfig := DefaultConfig()
+		cliConfig.Negotiate = true
+		a, b := net.Pipe()
+		cli := Client(a, cliConfig)
+		srv := Server(b, srvConfig)
+
+		// streams are never accepted, so both limits are reached at the third
+		var streams []*Stream
+		for i := 0; i < 3; i++ {
+			stream, err := cli.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			streams = append(streams, stream)
+		}
+
+		_ = streams[2].SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := streams[2].Read(make([]byte, 1))
+		if !errors.Is(err, ErrTooManyStreams) {
+			t.Fatalf("%s: expected ErrTooManyStreams, got %v", name, err)
+		}
+		_ = streams[0].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := streams[0].Read(make([]byte, 1)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected the first stream alive, got %v", name, err)
+		}
+		if n := srv.NumStreams(); n != 2 {
+			t.Fatalf("%s: expected 2 streams on server, got %d", name, n)
+		}
+
+		// the local side is limited as well
+		if config.MaxStreams > 0 {
+			if _, err := srv.OpenStream(); !errors.Is(err, ErrTooManyStreams) {
+				t.Fatalf("%s: expected ErrTooManyStreams opening, got %v", name, err)
+			}
+		}
+		_ = cli.Close()
+		_ = srv.Close()
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.StreamIdleTimeout = 100 * time.Millisecond
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+	idle, remote := openPair(t, cli, srv)
+	remote.SetIdleTimeout(0) // told by the client
+	kept, keptRemote := openPair(t, cli, srv)
+	kept.SetIdleTimeout(0)
+	keptRemote.SetIdleTimeout(0)
+
+	start := time.Now()
+	_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, ErrStreamIdle) {
+		t.Fatalf("expected ErrStreamIdle, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("closed after %v", elapsed)
+	}
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var serr *StreamError
+	if _, err := remote.Read(make([]byte, 1)); !errors.As(err, &serr) || !serr.Remote || !errors.Is(err, ErrStreamIdle) {
+		t.Fatalf("expected remote ErrStreamIdle, got %v", err)
+	}
+
+	_ = kept.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := kept.Read(make([]byte, 1)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the stream without idle timeout alive, got %v", err)
+	}
+}
+
+func TestStreamIdleUnread(t *testing.T) {
+	config := DefaultConfig()
+	config.Negotiate = true
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+	remote.SetIdleTimeout(100 * time.Millisecond)
+
+	// data pushed into a stream nobody reads doesn't keep it alive
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := local.Write([]byte("ping"))
+		if errors.Is(err, ErrStreamIdle) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unread stream never idled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamIdleResetOnce(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.StreamIdleTimeout = time.Hour
+	srv := Server(b, config)
+	defer srv.Close()
+	defer a.Close()
+
+	// the peer never reads, the RST is stuck
+	if _, err := a.Write(appendHeader(nil, 1, cmdSYN, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := srv.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetIdleTimeout(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		srv.closeIdleStreams()
+	}
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Fatalf("%d goroutines resetting an idle stream", n)
+	}
+}
+
+func TestLargeFrames(t *testing.T) {
+	config := DefaultConfig()
+	config.Version = 3
+	config.MaxFrameSize = 1 << 20
+	config.MaxReceiveBuffer = 8 << 20
+	config.MaxStreamBuffer = 4 << 20
+	config.Compression = true
+	cli, srv := newSessionPair(t, config)
+	local, remote := openPair(t, cli, srv)
+
+	// compressible and not
+	msg := append(bytes.Repeat([]byte("large frames "), 1<<18), make([]byte, 1<<20)...)
+	for i := 1 << 20; i < len(msg); i++ {
+		msg[i] = byte(i * 7919 >> 3)
+	}
+	go func() { _, _ = local.Write(msg) }()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("data corrupted")
+	}
+	if sent := cli.Stats().SentByCmd; sent["PSH"].Frames+sent["ZPSH"].Frames > 5 {
+		t.Fatalf("%d bytes sent in %v", len(msg), sent)
+	}
+	if sent := cli.Stats().SentByCmd["ZPSH"].Frames; sent == 0 {
+		t.Fatal("no compressed frames")
+	}
+	// large frames don't grow the buffer kept by the session
+	if size := len(srv.inflateBuf); size > maxSmallFrameSize {
+		t.Fatalf("inflate buffer of %d bytes", size)
+	}
+}
+
+func TestLargeFramesNegotiate(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.Version = 2
+	config.Negotiate = true
+	config.MaxFrameSize = 1 << 20
+	config.Versions = []int{2, 3}
+	cli := Client(a, config)
+	defer cli.Close()
+
+	// the server does not ask for version 3
+	srvConfig := DefaultConfig()
+	srvConfig.Version = 2
+	srvConfig.Negotiate = true
+	srv := Server(b, srvConfig)
+	defer srv.Close()
+
+	local, remote := openPair(t, cli, srv)
+	if v := cli.Negotiated().Version; v != 2 {
+		t.Fatalf("negotiated version %d", v)
+	}
+	msg := make([]byte, 200000)
+	go func() { _, _ = local.Write(msg) }()
+	if _, err := io.ReadFull(remote, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Versions = nil
+	if err := VerifyConfig(config); err == nil {
+		t.Fatal("large frames accepted without version 3")
+	}
+}
+
+func TestBadLengthRateLimited(t *testing.T) {
+	a, b := net.Pipe()
+	config := DefaultConfig()
+	config.Version = 3
+	config.MaxFrameSize = 1 << 20
+	config.ReceiveRate = 1
+	srv := Server(b, config)
+	defer srv.Close()
+	defer a.Close()
+
+	// rejected at once, not after paying for 16MB at 1 byte per second
+	go func() { _, _ = a.Write(appendHeader(nil, 3, cmdPSH, maxLargeFrameSize+1, 1)) }()
+	_ = srv.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.AcceptStream(); !errors.Is(err, ErrInvalidProtocol) {
+		t.Fatalf("expected ErrInvalidProtocol, got %v", err)
+	}
+}
@@ -6,12 +6,18 @@ func _itimediff(later, earlier uint32) int32 {
 
 type shaperHeap []writeRequest
 
-func (h shaperHeap) Len() int { return len(h) }
-func (h shaperHeap) Less(i, j int) bool {
-	if h[i].class != h[j].class {
-		return h[i].class < h[j].class
+func (h shaperHeap) Len() int           { return len(h) }
+func (h shaperHeap) Less(i, j int) bool { return sendsBefore(&h[i], &h[j]) }
+
+// sendsBefore tells if a is sent before b
+func sendsBefore(a, b *writeRequest) bool {
+	if a.class != b.class {
+		return a.class < b.class
+	}
+	if a.finish != b.finish {
+		return a.finish < b.finish
 	}
-	return _itimediff(h[j].seq, h[i].seq) > 0
+	return _itimediff(b.seq, a.seq) > 0
 }
 
 func (h shaperHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
@@ -24,3 +30,70 @@ func (h *shaperHeap) Pop() interface{} {
 	*h = old[0 : n-1]
 	return x
 }
+
+const (
+	// MinStreamWeight is the lowest weight of a stream
+	MinStreamWeight = 1
+	// MaxStreamWeight is the highest weight of a stream
+	MaxStreamWeight = 256
+	// DefaultStreamWeight is the weight of a stream unless Config.StreamWeight
+	// or Stream.SetWeight says otherwise
+	DefaultStreamWeight = 16
+)
+
+// fairQueue implements weighted fair queueing among streams of the data class:
+// each frame is stamped with a virtual finish time, which advances by the
+// frame size divided by the stream weight, frames with earlier finish time go
+// first. Thus streams share the bandwidth in proportion to their weights, and
+// a bulk stream can't starve an interactive one with a long queue.
+type fairQueue struct {
+	vtime  uint64            // virtual time, finish time of the last frame sent
+	finish map[uint32]uint64 // last finish time per stream
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{finish: make(map[uint32]uint64)}
+}
+
+// enqueue stamps the finish time of r
+func (q *fairQueue) enqueue(r *writeRequest) {
+	if r.class != CLSDATA {
+		return
+	}
+
+	sid := r.frame.sid
+	start := q.vtime
+	if last := q.finish[sid]; last > start {
+		start = last
+	}
+	cost := uint64(len(r.frame.data)+headerSize) * MaxStreamWeight / uint64(r.weight)
+	r.finish = start + cost
+	q.finish[sid] = r.finish
+
+	// streams idle since vtime are same as absent
+	if len(q.finish) > maxShaperSize {
+		for id, last := range q.finish {
+			if last <= q.vtime {
+				delete(q.finish, id)
+			}
+		}
+	}
+}
+
+// dequeue advances the virtual time when r is sent
+func (q *fairQueue) dequeue(r *writeRequest) {
+	if r.class == CLSDATA && r.finish > q.vtime {
+		q.vtime = r.finish
+	}
+}
+
+// clampWeight limits weight to [MinStreamWeight, MaxStreamWeight]
+func clampWeight(weight int) int {
+	if weight < MinStreamWeight {
+		return MinStreamWeight
+	}
+	if weight > MaxStreamWeight {
+		return MaxStreamWeight
+	}
+	return weight
+}
@@ -0,0 +1,47 @@
+package smux
+
+import (
+	"container/heap"
+	"testing"
+)
+
+func TestShaperWeightedFair(t *testing.T) {
+	var reqs shaperHeap
+	fair := newFairQueue()
+	push := func(sid uint32, size, weight int) {
+		r := writeRequest{class: CLSDATA, frame: Frame{sid: sid, data: make([]byte, size)}, weight: weight}
+		r.seq = uint32(len(reqs))
+		fair.enqueue(&r)
+		heap.Push(&reqs, r)
+	}
+
+	// a bulk stream queued 8 large frames before an interactive one
+	for i := 0; i < 8; i++ {
+		push(1, 32768, MinStreamWeight)
+	}
+	push(3, 64, MaxStreamWeight)
+	push(3, 64, MaxStreamWeight)
+
+	var order []uint32
+	for reqs.Len() > 0 {
+		r := heap.Pop(&reqs).(writeRequest)
+		fair.dequeue(&r)
+		order = append(order, r.frame.sid)
+	}
+	if order[0] != 3 || order[1] != 3 {
+		t.Fatalf("interactive stream starved: %v", order)
+	}
+}
+
+func TestShaperControlFirst(t *testing.T) {
+	var reqs shaperHeap
+	fair := newFairQueue()
+	data := writeRequest{class: CLSDATA, frame: Frame{sid: 1, data: []byte{1}}, weight: MaxStreamWeight, seq: 1}
+	fair.enqueue(&data)
+	heap.Push(&reqs, data)
+	heap.Push(&reqs, writeRequest{class: CLSCTRL, seq: 2})
+
+	if r := heap.Pop(&reqs).(writeRequest); r.class != CLSCTRL {
+		t.Fatal("control frame must go first")
+	}
+}
@@ -0,0 +1,114 @@
+package smuxtest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/smux"
+)
+
+// smuxFrames marks the goroutines running smux code in a stack dump
+const smuxFrames = "vela-common-mba/smux."
+
+// leakTimeout is how long goroutines get to exit once the test is done
+const leakTimeout = 5 * time.Second
+
+// CheckLeaks fails the test if goroutines running smux code, started
+// during the test, are still alive once it's done, e.g. the loops of a
+// session which was not closed, or a stream handler blocked on a Read.
+// It must be called first, its check runs after the cleanups registered
+// later, such as the ones of Pair.
+func CheckLeaks(t testing.TB) {
+	t.Helper()
+	before := goroutines()
+	t.Cleanup(func() {
+		var leaked []string
+		for deadline := time.Now().Add(leakTimeout); ; time.Sleep(10 * time.Millisecond) {
+			leaked = leaked[:0]
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; !ok && strings.Contains(stack, smuxFrames) {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+		}
+		if len(leaked) > 0 {
+			t.Errorf("%d leaked goroutines:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+	})
+}
+
+// goroutines returns the stacks of the other goroutines by id
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[string]string)
+	for i, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if i == 0 {
+			continue // the current goroutine
+		}
+		// goroutine 42 [chan receive]:
+		fields := strings.Fields(string(stack))
+		if len(fields) > 1 {
+			stacks[fields[1]] = string(stack)
+		}
+	}
+	return stacks
+}
+
+// Pair creates a client and a server session connected in memory, they are
+// closed when the test is done.
+func Pair(t testing.TB, opts ...smux.Option) (client, server *smux.Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, err := smux.NewClient(a, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = smux.NewServer(b, opts...)
+	if err != nil {
+		_ = client.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// WaitFailed waits for the session to fail or close, and returns the
+// failure, nil if it was closed locally, see Session.CloseReason. A session
+// stops reading on a protocol error but is not closed, Close is still due.
+func WaitFailed(sess *smux.Session, timeout time.Duration) (reason error, err error) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		if reason := sess.CloseReason(); reason != nil {
+			return reason, nil
+		}
+		select {
+		case <-sess.CloseChan():
+			return sess.CloseReason(), nil
+		case <-ticker.C:
+		case <-deadline:
+			return nil, fmt.Errorf("session alive after %v: %w", timeout, ErrTimeout)
+		}
+	}
+}
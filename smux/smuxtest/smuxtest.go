@@ -0,0 +1,267 @@
+// Package smuxtest provides utilities for smux testing.
+//
+// A Peer speaks the smux wire protocol by hand over an in-memory
+// connection, it sends arbitrary frames, valid or not, to a Session and
+// reads back what the Session answers. It's meant to check how a Session,
+// and the stream handlers served by it, react to a misbehaving peer:
+//
+//	peer, conn := smuxtest.NewPeer(1)
+//	sess, _ := smux.NewServer(conn)
+//	_ = peer.WriteFrame(smuxtest.Frame{Version: 1, Cmd: smuxtest.CmdFIN, StreamID: 3})
+//
+// Sessions with encryption or an obfuscation password can not be driven by
+// a Peer, its frames are plain.
+package smuxtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Commands of the smux wire protocol.
+const (
+	CmdSYN byte = iota
+	CmdFIN
+	CmdPSH
+	CmdNOP
+	CmdUPD
+	CmdSTOP
+	CmdGOAWAY
+	CmdPING
+	CmdPONG
+	CmdRST
+	CmdZPSH
+	CmdMSG
+	CmdMUPD
+)
+
+// HeaderSize is the size of a frame header, format:
+// |1B version|1B cmd|2B length|4B stream id|, little-endian.
+// Protocol version 3 appends the high bits of the length:
+// |2B length high|, its headers are LargeHeaderSize long.
+const (
+	HeaderSize      = 8
+	LargeHeaderSize = HeaderSize + 2
+)
+
+// maxFrameSize bounds the frames read from the session
+const maxFrameSize = 16 << 20
+
+// ErrTimeout is returned when the session sends no expected frame in time.
+var ErrTimeout = errors.New("smuxtest: timeout")
+
+// Frame is a frame exchanged with the session.
+type Frame struct {
+	Version  byte
+	Cmd      byte
+	StreamID uint32
+	Data     []byte
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("Version:%d Cmd:%d StreamID:%d Length:%d", f.Version, f.Cmd, f.StreamID, len(f.Data))
+}
+
+// Peer is the scripted end of a connection to a Session.
+//
+// The frames sent by the session are read in the background, so the
+// session never blocks writing to the peer, and returned by ReadFrame.
+type Peer struct {
+	// Version is used by the helpers sending well-formed frames.
+	Version byte
+
+	conn net.Conn
+
+	mu     sync.Mutex
+	frames []Frame
+	err    error         // read error once the connection is done
+	notify chan struct{} // signaled on new frames
+}
+
+// NewPeer creates a peer speaking the protocol version, and returns the
+// connection to give to the session under test.
+func NewPeer(version byte) (*Peer, net.Conn) {
+	a, b := net.Pipe()
+	p := &Peer{
+		Version: version,
+		conn:    a,
+		notify:  make(chan struct{}, 1),
+	}
+	go p.readLoop()
+	return p, b
+}
+
+func (p *Peer) readLoop() {
+	var hdr [LargeHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(p.conn, hdr[:HeaderSize]); err != nil {
+			p.done(err)
+			return
+		}
+		length := uint32(binary.LittleEndian.Uint16(hdr[2:]))
+		if hdr[0] >= 3 {
+			if _, err := io.ReadFull(p.conn, hdr[HeaderSize:]); err != nil {
+				p.done(err)
+				return
+			}
+			length |= uint32(binary.LittleEndian.Uint16(hdr[HeaderSize:])) << 16
+		}
+		if length > maxFrameSize {
+			p.done(fmt.Errorf("smuxtest: frame of %d bytes", length))
+			return
+		}
+
+		f := Frame{
+			Version:  hdr[0],
+			Cmd:      hdr[1],
+			StreamID: binary.LittleEndian.Uint32(hdr[4:]),
+			Data:     make([]byte, length),
+		}
+		if _, err := io.ReadFull(p.conn, f.Data); err != nil {
+			p.done(err)
+			return
+		}
+
+		p.mu.Lock()
+		p.frames = append(p.frames, f)
+		p.mu.Unlock()
+		p.signal()
+	}
+}
+
+func (p *Peer) done(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *Peer) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Write sends raw bytes, e.g. a truncated header.
+func (p *Peer) Write(b []byte) (int, error) {
+	return p.conn.Write(b)
+}
+
+// WriteHeader sends a frame header alone, length may lie about the data
+// which follows, if any. Its high bits are dropped before version 3.
+func (p *Peer) WriteHeader(version, cmd byte, length uint32, sid uint32) error {
+	_, err := p.conn.Write(appendHeader(nil, version, cmd, length, sid))
+	return err
+}
+
+// WriteFrame sends a frame, its length is the size of the data.
+func (p *Peer) WriteFrame(f Frame) error {
+	if (f.Version < 3 && len(f.Data) > 65535) || len(f.Data) > maxFrameSize {
+		return fmt.Errorf("smuxtest: frame data of %d bytes", len(f.Data))
+	}
+	buf := appendHeader(make([]byte, 0, LargeHeaderSize+len(f.Data)), f.Version, f.Cmd, uint32(len(f.Data)), f.StreamID)
+	_, err := p.conn.Write(append(buf, f.Data...))
+	return err
+}
+
+// appendHeader appends a frame header in the format of the version
+func appendHeader(buf []byte, version, cmd byte, length uint32, sid uint32) []byte {
+	buf = append(buf, version, cmd)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(length))
+	buf = binary.LittleEndian.AppendUint32(buf, sid)
+	if version >= 3 {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(length>>16))
+	}
+	return buf
+}
+
+// SYN opens the stream sid, it must be odd when the session is a server.
+func (p *Peer) SYN(sid uint32) error {
+	return p.WriteFrame(Frame{Version: p.Version, Cmd: CmdSYN, StreamID: sid})
+}
+
+// FIN closes the stream sid.
+func (p *Peer) FIN(sid uint32) error {
+	return p.WriteFrame(Frame{Version: p.Version, Cmd: CmdFIN, StreamID: sid})
+}
+
+// PSH sends data on the stream sid.
+func (p *Peer) PSH(sid uint32, data []byte) error {
+	return p.WriteFrame(Frame{Version: p.Version, Cmd: CmdPSH, StreamID: sid, Data: data})
+}
+
+// UPD sends a window update of the stream sid, protocol version 2.
+func (p *Peer) UPD(sid, consumed, window uint32) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data, consumed)
+	binary.LittleEndian.PutUint32(data[4:], window)
+	return p.WriteFrame(Frame{Version: p.Version, Cmd: CmdUPD, StreamID: sid, Data: data})
+}
+
+// PING sends a round-trip probe, the session answers with a PONG
+// carrying the same id.
+func (p *Peer) PING(id uint64) error {
+	data := binary.LittleEndian.AppendUint64(nil, id)
+	return p.WriteFrame(Frame{Version: p.Version, Cmd: CmdPING, Data: data})
+}
+
+// ReadFrame returns the next frame sent by the session, it fails with
+// ErrTimeout if none comes in time, and with the read error once the
+// connection is closed.
+func (p *Peer) ReadFrame(timeout time.Duration) (Frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		p.mu.Lock()
+		if len(p.frames) > 0 {
+			f := p.frames[0]
+			p.frames = p.frames[1:]
+			p.mu.Unlock()
+			return f, nil
+		}
+		err := p.err
+		p.mu.Unlock()
+		if err != nil {
+			return Frame{}, err
+		}
+
+		select {
+		case <-p.notify:
+		case <-timer.C:
+			return Frame{}, ErrTimeout
+		}
+	}
+}
+
+// Expect skips the frames sent by the session until one with the command
+// for the stream sid, such as PSH after the UPD frames, and returns it.
+func (p *Peer) Expect(cmd byte, sid uint32, timeout time.Duration) (Frame, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := p.ReadFrame(time.Until(deadline))
+		if err != nil {
+			return f, fmt.Errorf("expecting cmd %d of stream %d: %w", cmd, sid, err)
+		}
+		if f.Cmd == cmd && f.StreamID == sid {
+			return f, nil
+		}
+	}
+}
+
+// Closed tells whether the session closed the connection.
+func (p *Peer) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
+// Close closes the connection to the session.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,268 @@
+package smuxtest
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/smux"
+)
+
+const timeout = 5 * time.Second
+
+// newServer starts a server session speaking to a new peer
+func newServer(t *testing.T, version byte) (*Peer, *smux.Session) {
+	t.Helper()
+	peer, conn := NewPeer(version)
+	sess, err := smux.NewServer(conn, smux.WithVersion(int(version)), smux.WithoutKeepAlive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sess.Close()
+		_ = peer.Close()
+	})
+	return peer, sess
+}
+
+// expectAlive checks the session still serves the peer
+func expectAlive(t *testing.T, peer *Peer, sess *smux.Session) {
+	t.Helper()
+	if err := peer.PING(42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Expect(CmdPONG, 0, timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.SYN(101); err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.PSH(101, []byte("ping"))
+	_ = peer.FIN(101)
+	_ = sess.SetDeadline(time.Now().Add(timeout))
+	stream, err := sess.AcceptStream()
+	for err == nil && stream.ID() != 101 {
+		// opened by the test case
+		stream, err = sess.AcceptStream()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(timeout))
+	if data, err := io.ReadAll(stream); err != nil || string(data) != "ping" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	_ = stream.Close()
+}
+
+func TestMalformedFrames(t *testing.T) {
+	for name, send := range map[string]func(p *Peer) error{
+		"wrong version": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 9, Cmd: CmdPSH, StreamID: 1, Data: []byte("x")})
+		},
+		"unknown command": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 2, Cmd: 0x7f, StreamID: 1})
+		},
+		"short UPD": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 2, Cmd: CmdUPD, StreamID: 1, Data: []byte{1, 2, 3}})
+		},
+		"oversize PING": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 2, Cmd: CmdPING, Data: make([]byte, 65535)})
+		},
+		"FIN with data": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 2, Cmd: CmdFIN, StreamID: 1, Data: []byte("x")})
+		},
+		"oversize RST": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 2, Cmd: CmdRST, StreamID: 1, Data: make([]byte, 4096)})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			CheckLeaks(t)
+			peer, sess := newServer(t, 2)
+			// the session stops reading at the bad frame, the rest of
+			// it blocks on the pipe until the peer is closed
+			go send(peer)
+			reason, err := WaitFailed(sess, timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(reason, smux.ErrInvalidProtocol) {
+				t.Fatalf("expected a protocol error, got %v", reason)
+			}
+		})
+	}
+}
+
+func TestIgnoredFrames(t *testing.T) {
+	for name, send := range map[string]func(p *Peer) error{
+		"UPD of unknown stream": func(p *Peer) error { return p.UPD(7, 1024, 65536) },
+		"FIN before SYN":        func(p *Peer) error { return p.FIN(7) },
+		"PSH before SYN":        func(p *Peer) error { return p.PSH(7, []byte("lost")) },
+		"duplicated SYN": func(p *Peer) error {
+			_ = p.SYN(7)
+			return p.SYN(7)
+		},
+		"RST of unknown stream": func(p *Peer) error {
+			return p.WriteFrame(Frame{Version: 2, Cmd: CmdRST, StreamID: 9, Data: []byte{1, 0, 0, 0}})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			CheckLeaks(t)
+			peer, sess := newServer(t, 2)
+			if err := send(peer); err != nil {
+				t.Fatal(err)
+			}
+			expectAlive(t, peer, sess)
+			if reason := sess.CloseReason(); reason != nil {
+				t.Fatalf("session failed: %v", reason)
+			}
+		})
+	}
+}
+
+func TestTruncatedFrames(t *testing.T) {
+	t.Run("header", func(t *testing.T) {
+		CheckLeaks(t)
+		peer, sess := newServer(t, 1)
+		_, _ = peer.Write([]byte{1, CmdPSH, 4})
+		_ = peer.Close()
+		reason, err := WaitFailed(sess, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason == nil || errors.Is(reason, smux.ErrInvalidProtocol) {
+			t.Fatalf("expected a read error, got %v", reason)
+		}
+	})
+
+	t.Run("data", func(t *testing.T) {
+		CheckLeaks(t)
+		peer, sess := newServer(t, 1)
+		_ = peer.SYN(1)
+		_ = sess.SetDeadline(time.Now().Add(timeout))
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the length announces more than ever comes
+		_ = peer.WriteHeader(1, CmdPSH, 65535, 1)
+		_, _ = peer.Write([]byte("short"))
+		_ = peer.Close()
+
+		if _, err := WaitFailed(sess, timeout); err != nil {
+			t.Fatal(err)
+		}
+		_ = stream.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := stream.Read(make([]byte, 16)); err == nil || errors.Is(err, smux.ErrTimeout) {
+			t.Fatalf("expected the stream to fail, got %v", err)
+		}
+	})
+}
+
+func TestFloodThenClose(t *testing.T) {
+	CheckLeaks(t)
+	peer, sess := newServer(t, 2)
+	go func() {
+		for sid := uint32(1); ; sid += 2 {
+			if peer.PING(uint64(sid)) != nil || peer.SYN(sid) != nil || peer.PSH(sid, []byte("flood")) != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = sess.Close()
+	if _, err := peer.Expect(0xff, 0, timeout); err == nil || errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	CheckLeaks(t)
+	peer, sess := newServer(t, 2)
+	mux := smux.NewServeMux()
+	mux.HandleFunc("", func(stream *smux.Stream) {
+		_, _ = io.Copy(stream, stream)
+		_ = stream.Close()
+	})
+	go func() { _ = mux.Serve(sess) }()
+
+	_ = peer.SYN(1)
+	_ = peer.PSH(1, []byte("echo"))
+	f, err := peer.Expect(CmdPSH, 1, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Data) != "echo" {
+		t.Fatalf("echoed %q", f.Data)
+	}
+	_ = peer.FIN(1)
+	if _, err := peer.Expect(CmdFIN, 1, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPair(t *testing.T) {
+	CheckLeaks(t)
+	cli, srv := Pair(t, smux.WithVersion(2))
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = stream.Write([]byte("hello"))
+	_ = srv.SetDeadline(time.Now().Add(timeout))
+	if _, err := srv.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLargeFrames(t *testing.T) {
+	CheckLeaks(t)
+	peer, sess := newServer(t, 3)
+	data := make([]byte, 100000)
+	_ = peer.SYN(1)
+	_ = peer.PSH(1, data)
+	_ = sess.SetDeadline(time.Now().Add(timeout))
+	stream, err := sess.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(stream, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// a frame past the limit is refused before its data is read
+	_ = peer.WriteHeader(3, CmdPSH, 16<<20+1, 1)
+	reason, err := WaitFailed(sess, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(reason, smux.ErrInvalidProtocol) {
+		t.Fatalf("expected a protocol error, got %v", reason)
+	}
+}
+
+func TestMessageOverflow(t *testing.T) {
+	CheckLeaks(t)
+	peer, sess := newServer(t, 2)
+	// the peer ignores the credits granted and floods the backlog
+	go func() {
+		for i := 0; i < 100; i++ {
+			if peer.WriteFrame(Frame{Version: 2, Cmd: CmdMSG, Data: []byte("msg")}) != nil {
+				return
+			}
+		}
+	}()
+	if _, err := peer.Expect(CmdMUPD, 0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := WaitFailed(sess, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(reason, smux.ErrInvalidProtocol) {
+		t.Fatalf("expected a protocol error, got %v", reason)
+	}
+}
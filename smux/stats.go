@@ -0,0 +1,181 @@
+package smux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// cmdNames names the commands in statistics, indexed by command
+var cmdNames = [...]string{
+	cmdSYN:    "SYN",
+	cmdFIN:    "FIN",
+	cmdPSH:    "PSH",
+	cmdNOP:    "NOP",
+	cmdUPD:    "UPD",
+	cmdSTOP:   "STOP",
+	cmdGOAWAY: "GOAWAY",
+	cmdPING:   "PING",
+	cmdPONG:   "PONG",
+	cmdRST:    "RST",
+	cmdZPSH:   "ZPSH",
+	cmdMSG:    "MSG",
+	cmdMUPD:   "MUPD",
+}
+
+// FrameStats counts frames and their bytes, headers included.
+type FrameStats struct {
+	Frames uint64 `json:"frames"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// SessionStats is a snapshot of session statistics.
+type SessionStats struct {
+	Created       time.Time             `json:"created"`
+	Sent          FrameStats            `json:"sent"`            // all frames sent
+	Received      FrameStats            `json:"received"`        // all frames received
+	SentByCmd     map[string]FrameStats `json:"sent_by_cmd"`     // frames sent per command
+	ReceivedByCmd map[string]FrameStats `json:"received_by_cmd"` // frames received per command
+	Bucket        int                   `json:"bucket"`          // receive tokens available
+	ReceiveBuffer int                   `json:"receive_buffer"`  // bytes received but not yet read
+	ShaperQueue   int                   `json:"shaper_queue"`    // frames waiting in the shaper
+	AcceptBacklog int                   `json:"accept_backlog"`  // streams waiting to be accepted
+	Streams       int                   `json:"streams"`         // open streams
+	KeepAliveSent time.Time             `json:"keepalive_sent"`  // last keepalive sent, zero if disabled
+	LastReceived  time.Time             `json:"last_received"`   // last frame received
+	RTT           time.Duration         `json:"rtt"`             // smoothed round-trip time, zero if never pinged
+
+	CompressionSent     CompressionStats `json:"compression_sent"`
+	CompressionReceived CompressionStats `json:"compression_received"`
+
+	Budget *BudgetStats `json:"budget,omitempty"` // shared memory budget, nil if none
+}
+
+// StreamStats is a snapshot of stream statistics.
+type StreamStats struct {
+	ID           uint32    `json:"id"`
+	Created      time.Time `json:"created"`
+	LastActivity time.Time `json:"last_activity"` // last read, write or arrival of data
+	BytesIn      uint64    `json:"bytes_in"`      // data bytes received from the peer
+	BytesOut     uint64    `json:"bytes_out"`     // data bytes sent to the peer
+	Buffered     int       `json:"buffered"`      // bytes received but not yet read
+	PeerWindow   uint32    `json:"peer_window"`   // window advertised by the peer, protocol version 2
+	Weight       int       `json:"weight"`
+}
+
+// frameCounter counts frames of one command
+type frameCounter struct {
+	frames atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+// sessionCounters holds the counters of a session
+type sessionCounters struct {
+	created       time.Time
+	sent          [len(cmdNames)]frameCounter
+	received      [len(cmdNames)]frameCounter
+	shaperQueue   atomic.Int32
+	keepAliveSent atomic.Int64 // unix nano
+	lastReceived  atomic.Int64 // unix nano
+
+	compressionSent     compressionCounters
+	compressionReceived compressionCounters
+}
+
+func (c *sessionCounters) countSent(cmd byte, size int) {
+	if int(cmd) < len(c.sent) {
+		c.sent[cmd].frames.Add(1)
+		c.sent[cmd].bytes.Add(uint64(size))
+	}
+}
+
+func (c *sessionCounters) countReceived(cmd byte, size int) {
+	c.lastReceived.Store(time.Now().UnixNano())
+	if int(cmd) < len(c.received) {
+		c.received[cmd].frames.Add(1)
+		c.received[cmd].bytes.Add(uint64(size))
+	}
+}
+
+// streamCounters holds the counters of a stream
+type streamCounters struct {
+	created      time.Time
+	lastActivity atomic.Int64 // unix nano
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+}
+
+func (c *streamCounters) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Stats returns a snapshot of the session statistics.
+func (s *Session) Stats() SessionStats {
+	stats := SessionStats{
+		Created:       s.counters.created,
+		SentByCmd:     make(map[string]FrameStats, len(cmdNames)),
+		ReceivedByCmd: make(map[string]FrameStats, len(cmdNames)),
+		Bucket:        int(atomic.LoadInt32(&s.bucket)),
+		ShaperQueue:   int(s.counters.shaperQueue.Load()),
+		AcceptBacklog: len(s.chAccepts),
+		Streams:       s.NumStreams(),
+		KeepAliveSent: unixNano(s.counters.keepAliveSent.Load()),
+		LastReceived:  unixNano(s.counters.lastReceived.Load()),
+		RTT:           s.RTT(),
+
+		CompressionSent:     s.counters.compressionSent.stats(),
+		CompressionReceived: s.counters.compressionReceived.stats(),
+	}
+	stats.ReceiveBuffer = s.config.MaxReceiveBuffer - stats.Bucket
+	if s.budget != nil {
+		budget := s.budget.Stats()
+		stats.Budget = &budget
+	}
+
+	for cmd, name := range cmdNames {
+		sent := FrameStats{
+			Frames: s.counters.sent[cmd].frames.Load(),
+			Bytes:  s.counters.sent[cmd].bytes.Load(),
+		}
+		received := FrameStats{
+			Frames: s.counters.received[cmd].frames.Load(),
+			Bytes:  s.counters.received[cmd].bytes.Load(),
+		}
+		stats.SentByCmd[name] = sent
+		stats.ReceivedByCmd[name] = received
+		stats.Sent.Frames += sent.Frames
+		stats.Sent.Bytes += sent.Bytes
+		stats.Received.Frames += received.Frames
+		stats.Received.Bytes += received.Bytes
+	}
+
+	return stats
+}
+
+// Stats returns a snapshot of the stream statistics.
+func (s *Stream) Stats() StreamStats {
+	stats := StreamStats{
+		ID:           s.id,
+		Created:      s.counters.created,
+		LastActivity: unixNano(s.counters.lastActivity.Load()),
+		BytesIn:      s.counters.bytesIn.Load(),
+		BytesOut:     s.counters.bytesOut.Load(),
+		PeerWindow:   atomic.LoadUint32(&s.peerWindow),
+		Weight:       s.Weight(),
+	}
+
+	s.bufferLock.Lock()
+	for _, buf := range s.buffers {
+		stats.Buffered += len(buf)
+	}
+	s.bufferLock.Unlock()
+
+	return stats
+}
+
+// unixNano converts unix nano to time, zero stays zero
+func unixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -32,6 +32,16 @@ type Stream struct {
 	chFinEvent   chan struct{}
 	finEventOnce sync.Once
 
+	// STOP command
+	chStopEvent   chan struct{}
+	stopEventOnce sync.Once
+
+	// half-close
+	chWriteClosed  chan struct{}
+	writeCloseOnce sync.Once
+	chReadClosed   chan struct{}
+	readCloseOnce  sync.Once
+
 	// deadlines
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
@@ -45,6 +55,30 @@ type Stream struct {
 	peerConsumed uint32        // num of bytes the peer has consumed
 	peerWindow   uint32        // peer window, initialized to 256KB, updated by peer
 	chUpdate     chan struct{} // notify of remote data consuming and window update
+
+	// weighted fair queueing
+	weight int32
+
+	noCompression int32 // flag data frames are sent uncompressed
+
+	// bandwidth limits
+	sendLimiter *rateLimiter
+	recvLimiter *rateLimiter
+
+	idleTimeout atomic.Int64 // nanoseconds, 0 for none
+	lastIO      atomic.Int64 // unix nano of the last read or write
+	idleExpired int32        // flag the janitor is resetting the stream
+
+	gone int32 // flag the close has been reported
+
+	counters streamCounters
+
+	meta Metadata // metadata carried by SYN
+
+	// RST command
+	resetErr  atomic.Value // *StreamError
+	chReset   chan struct{}
+	resetOnce sync.Once
 }
 
 // newStream initiates a Stream struct
@@ -57,7 +91,23 @@ func newStream(id uint32, frameSize int, sess *Session) *Stream {
 	s.sess = sess
 	s.die = make(chan struct{})
 	s.chFinEvent = make(chan struct{})
+	s.chStopEvent = make(chan struct{})
+	s.chWriteClosed = make(chan struct{})
+	s.chReadClosed = make(chan struct{})
+	s.chReset = make(chan struct{})
 	s.peerWindow = initialPeerWindow // set to initial window size
+	s.counters.created = time.Now()
+	s.touch()
+	s.weight = DefaultStreamWeight
+	if w := sess.config.StreamWeight; w != 0 {
+		s.weight = int32(clampWeight(w))
+	}
+	s.sendLimiter = newRateLimiter(sess.config.StreamSendRate)
+	s.recvLimiter = newRateLimiter(sess.config.StreamReceiveRate)
+	s.idleTimeout.Store(int64(sess.config.StreamIdleTimeout))
+	if sess.config.StreamIdleTimeout > 0 {
+		sess.notifyJanitor()
+	}
 	return s
 }
 
@@ -66,8 +116,47 @@ func (s *Stream) ID() uint32 {
 	return s.id
 }
 
+// SetWeight changes the share of the session bandwidth the stream gets when
+// streams compete for sending, it's proportional to the weight. The weight
+// is clamped to [MinStreamWeight, MaxStreamWeight], e.g. an interactive shell
+// may use MaxStreamWeight while a bulk transfer uses MinStreamWeight.
+// It takes effect on the frames written afterwards.
+func (s *Stream) SetWeight(weight int) {
+	atomic.StoreInt32(&s.weight, int32(clampWeight(weight)))
+}
+
+// Weight returns the current weight of the stream.
+func (s *Stream) Weight() int {
+	return int(atomic.LoadInt32(&s.weight))
+}
+
+// writeFrame writes a data frame scheduled according to the stream weight
+func (s *Stream) writeFrame(f Frame, deadline <-chan time.Time) (int, error) {
+	req := writeRequest{class: CLSDATA, frame: s.compressFrame(f), weight: s.Weight()}
+	if err := s.waitSendLimit(req.frame, deadline); err != nil {
+		return 0, err
+	}
+	n, err := s.sess.writeRequestCancel(req, deadline, nil, nil)
+	if f.cmd == cmdPSH {
+		if err == nil {
+			n = len(f.data) // count the data before compression
+		}
+		s.counters.bytesOut.Add(uint64(n))
+		s.touch()
+	}
+	return n, err
+}
+
 // Read implements net.Conn
 func (s *Stream) Read(b []byte) (n int, err error) {
+	if err = s.resetError(); err != nil {
+		return 0, err
+	}
+
+	if err = s.waitReadLimit(); err != nil {
+		return 0, err
+	}
+
 	for {
 		n, err = s.tryRead(b)
 		if err == ErrWouldBlock {
@@ -75,6 +164,7 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 				return 0, ew
 			}
 		} else {
+			s.recvLimiter.take(n)
 			return n, err
 		}
 	}
@@ -82,7 +172,7 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 
 // tryRead is the nonblocking version of Read
 func (s *Stream) tryRead(b []byte) (n int, err error) {
-	if s.sess.config.Version == 2 {
+	if s.sess.version() >= 2 {
 		return s.tryReadv2(b)
 	}
 
@@ -105,6 +195,7 @@ func (s *Stream) tryRead(b []byte) (n int, err error) {
 	s.bufferLock.Unlock()
 
 	if n > 0 {
+		s.touch()
 		s.sess.returnTokens(n)
 		return n, nil
 	}
@@ -112,6 +203,8 @@ func (s *Stream) tryRead(b []byte) (n int, err error) {
 	select {
 	case <-s.die:
 		return 0, io.EOF
+	case <-s.chReadClosed:
+		return 0, io.EOF
 	default:
 		return 0, ErrWouldBlock
 	}
@@ -151,6 +244,7 @@ func (s *Stream) tryReadv2(b []byte) (n int, err error) {
 	s.bufferLock.Unlock()
 
 	if n > 0 {
+		s.touch()
 		s.sess.returnTokens(n)
 		if notifyConsumed > 0 {
 			err := s.sendWindowUpdate(notifyConsumed)
@@ -163,6 +257,8 @@ func (s *Stream) tryReadv2(b []byte) (n int, err error) {
 	select {
 	case <-s.die:
 		return 0, io.EOF
+	case <-s.chReadClosed:
+		return 0, io.EOF
 	default:
 		return 0, ErrWouldBlock
 	}
@@ -170,11 +266,15 @@ func (s *Stream) tryReadv2(b []byte) (n int, err error) {
 
 // WriteTo implements io.WriteTo
 func (s *Stream) WriteTo(w io.Writer) (n int64, err error) {
-	if s.sess.config.Version == 2 {
+	if s.sess.version() >= 2 {
 		return s.writeTov2(w)
 	}
 
 	for {
+		if err := s.waitReadLimit(); err != nil {
+			return n, err
+		}
+
 		var buf []byte
 		s.bufferLock.Lock()
 		if len(s.buffers) > 0 {
@@ -185,7 +285,9 @@ func (s *Stream) WriteTo(w io.Writer) (n int64, err error) {
 		s.bufferLock.Unlock()
 
 		if buf != nil {
+			s.recvLimiter.take(len(buf))
 			nw, ew := w.Write(buf)
+			s.touch()
 			s.sess.returnTokens(len(buf))
 			defaultAllocator.Put(buf)
 			if nw > 0 {
@@ -203,6 +305,10 @@ func (s *Stream) WriteTo(w io.Writer) (n int64, err error) {
 
 func (s *Stream) writeTov2(w io.Writer) (n int64, err error) {
 	for {
+		if err := s.waitReadLimit(); err != nil {
+			return n, err
+		}
+
 		var notifyConsumed uint32
 		var buf []byte
 		s.bufferLock.Lock()
@@ -220,7 +326,9 @@ func (s *Stream) writeTov2(w io.Writer) (n int64, err error) {
 		s.bufferLock.Unlock()
 
 		if buf != nil {
+			s.recvLimiter.take(len(buf))
 			nw, ew := w.Write(buf)
+			s.touch()
 			s.sess.returnTokens(len(buf))
 			defaultAllocator.Put(buf)
 			if nw > 0 {
@@ -242,6 +350,31 @@ func (s *Stream) writeTov2(w io.Writer) (n int64, err error) {
 	}
 }
 
+// ReadFrom implements io.ReaderFrom, it copies r until EOF like io.Copy, with
+// a pooled buffer of the frame size in place of io.Copy's 32KB one, so that
+// every read of r goes out as at most one frame.
+func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := defaultAllocator.Get(s.frameSize)
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := s.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				// the frame may still be queued, buf is not recycled
+				return n, ew
+			}
+		}
+		if er != nil {
+			defaultAllocator.Put(buf)
+			if er == io.EOF {
+				er = nil
+			}
+			return n, er
+		}
+	}
+}
+
 func (s *Stream) sendWindowUpdate(consumed uint32) error {
 	var timer *time.Timer
 	var deadline <-chan time.Time
@@ -251,13 +384,18 @@ func (s *Stream) sendWindowUpdate(consumed uint32) error {
 		deadline = timer.C
 	}
 
-	frame := newFrame(byte(s.sess.config.Version), cmdUPD, s.id)
+	_, err := s.sess.writeFrameInternal(s.windowUpdate(consumed), deadline, CLSCTRL)
+	return err
+}
+
+// windowUpdate builds the UPD frame acknowledging consumed bytes
+func (s *Stream) windowUpdate(consumed uint32) Frame {
+	frame := newFrame(s.sess.version(), cmdUPD, s.id)
 	var hdr updHeader
 	binary.LittleEndian.PutUint32(hdr[:], consumed)
 	binary.LittleEndian.PutUint32(hdr[4:], uint32(s.sess.config.MaxStreamBuffer))
 	frame.data = hdr[:]
-	_, err := s.sess.writeFrameInternal(frame, deadline, CLSDATA)
-	return err
+	return frame
 }
 
 func (s *Stream) waitRead() error {
@@ -286,7 +424,14 @@ func (s *Stream) waitRead() error {
 		return s.sess.protoError.Load().(error)
 	case <-deadline:
 		return context.DeadlineExceeded
+	case <-s.chReadClosed:
+		return io.EOF
+	case <-s.chReset:
+		return s.resetError()
 	case <-s.die:
+		if err := s.resetError(); err != nil {
+			return err
+		}
 		return io.ErrClosedPipe
 	}
 }
@@ -296,7 +441,7 @@ func (s *Stream) waitRead() error {
 // Note that the behavior when multiple goroutines write concurrently is not deterministic,
 // frames may interleave in random way.
 func (s *Stream) Write(b []byte) (n int, err error) {
-	if s.sess.config.Version == 2 {
+	if s.sess.version() >= 2 {
 		return s.writeV2(b)
 	}
 
@@ -308,24 +453,25 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 	}
 
 	// check if stream has closed
-	select {
-	case <-s.die:
-		return 0, io.ErrClosedPipe
-	default:
+	if err := s.writable(); err != nil {
+		return 0, err
 	}
 
 	// frame split and transmit
 	sent := 0
-	frame := newFrame(byte(s.sess.config.Version), cmdPSH, s.id)
+	frame := newFrame(s.sess.version(), cmdPSH, s.id)
 	bts := b
 	for len(bts) > 0 {
+		if err := s.writable(); err != nil {
+			return sent, err
+		}
 		sz := len(bts)
 		if sz > s.frameSize {
 			sz = s.frameSize
 		}
 		frame.data = bts[:sz]
 		bts = bts[sz:]
-		n, err := s.sess.writeFrameInternal(frame, deadline, CLSDATA)
+		n, err := s.writeFrame(frame, deadline)
 		s.numWritten++
 		sent += n
 		if err != nil {
@@ -343,10 +489,8 @@ func (s *Stream) writeV2(b []byte) (n int, err error) {
 	}
 
 	// check if stream has closed
-	select {
-	case <-s.die:
-		return 0, io.ErrClosedPipe
-	default:
+	if err := s.writable(); err != nil {
+		return 0, err
 	}
 
 	// create write deadline timer
@@ -359,7 +503,7 @@ func (s *Stream) writeV2(b []byte) (n int, err error) {
 
 	// frame split and transmit process
 	sent := 0
-	frame := newFrame(byte(s.sess.config.Version), cmdPSH, s.id)
+	frame := newFrame(s.sess.version(), cmdPSH, s.id)
 
 	for {
 		// per stream sliding window control
@@ -393,7 +537,7 @@ func (s *Stream) writeV2(b []byte) (n int, err error) {
 				}
 				frame.data = bts[:sz]
 				bts = bts[sz:]
-				n, err := s.sess.writeFrameInternal(frame, deadline, CLSDATA)
+				n, err := s.writeFrame(frame, deadline)
 				atomic.AddUint32(&s.numWritten, uint32(sz))
 				sent += n
 				if err != nil {
@@ -406,11 +550,17 @@ func (s *Stream) writeV2(b []byte) (n int, err error) {
 		// wait until stream closes, window changes or deadline reached
 		// this blocking behavior will inform upper layer to do flow control
 		if len(b) > 0 {
+			// a FIN only ends the peer's writing side, it keeps on
+			// reading and sending window updates
 			select {
-			case <-s.chFinEvent: // if fin arrived, future window update is impossible
-				return 0, io.EOF
+			case <-s.chReset:
+				return sent, s.resetError()
 			case <-s.die:
 				return sent, io.ErrClosedPipe
+			case <-s.chWriteClosed:
+				return sent, io.ErrClosedPipe
+			case <-s.chStopEvent:
+				return sent, ErrBrokenPipe
 			case <-deadline:
 				return sent, context.DeadlineExceeded
 			case <-s.sess.chSocketWriteError:
@@ -434,7 +584,10 @@ func (s *Stream) Close() error {
 	})
 
 	if once {
-		_, err = s.sess.writeFrame(newFrame(byte(s.sess.config.Version), cmdFIN, s.id))
+		if !s.remoteReset() {
+			s.stopPeer()
+			_, err = s.sendFin()
+		}
 		s.sess.streamClosed(s.id)
 		return err
 	} else {
@@ -442,6 +595,105 @@ func (s *Stream) Close() error {
 	}
 }
 
+// CloseWrite shuts down the writing side of the stream, a FIN is sent to
+// the remote peer, while the stream keeps on reading until the peer closes.
+// Close must still be called to release the stream.
+func (s *Stream) CloseWrite() error {
+	select {
+	case <-s.die:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	sent, err := s.sendFin()
+	if !sent {
+		return io.ErrClosedPipe
+	}
+	return err
+}
+
+// CloseRead shuts down the reading side of the stream, the buffered data is
+// discarded and the remote peer is told to stop sending, subsequent writes on
+// the remote stream fail with ErrBrokenPipe. A peer without negotiation is
+// not told, the data it keeps on sending is discarded and acknowledged, so
+// the peer is not blocked.
+func (s *Stream) CloseRead() error {
+	select {
+	case <-s.die:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	var once bool
+	s.readCloseOnce.Do(func() {
+		close(s.chReadClosed)
+		once = true
+	})
+	if !once {
+		return io.ErrClosedPipe
+	}
+
+	if n := s.recycleTokens(); n > 0 {
+		s.sess.returnTokens(n)
+		s.discardWindow(n)
+	}
+	if !s.sess.peerExtended() {
+		return nil
+	}
+	_, err := s.sess.writeFrame(newFrame(s.sess.version(), cmdSTOP, s.id))
+	return err
+}
+
+// stopPeer tells the remote peer which may still be writing that nobody
+// reads anymore, so that its writes waiting for window updates fail
+func (s *Stream) stopPeer() {
+	if !s.sess.peerExtended() || s.readClosed() {
+		return
+	}
+	select {
+	case <-s.chFinEvent:
+		return // the peer is done writing
+	default:
+	}
+	_, _ = s.sess.writeFrame(newFrame(s.sess.version(), cmdSTOP, s.id))
+}
+
+// sendFin sends FIN to the remote peer at most once
+func (s *Stream) sendFin() (sent bool, err error) {
+	s.writeCloseOnce.Do(func() {
+		close(s.chWriteClosed)
+		sent = true
+		_, err = s.sess.writeFrame(newFrame(s.sess.version(), cmdFIN, s.id))
+	})
+	return
+}
+
+// writable checks if the writing side of the stream is still open
+func (s *Stream) writable() error {
+	select {
+	case <-s.chReset:
+		return s.resetError()
+	case <-s.die:
+		return io.ErrClosedPipe
+	case <-s.chWriteClosed:
+		return io.ErrClosedPipe
+	case <-s.chStopEvent:
+		return ErrBrokenPipe
+	default:
+		return nil
+	}
+}
+
+// readClosed checks if the reading side of the stream has been shut down
+func (s *Stream) readClosed() bool {
+	select {
+	case <-s.chReadClosed:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetDieCh returns a readonly chan which can be readable
 // when the stream is to be closed.
 func (s *Stream) GetDieCh() <-chan struct{} {
@@ -493,6 +745,7 @@ func (s *Stream) RemoteAddr() net.Addr {
 
 // pushBytes append buf to buffers
 func (s *Stream) pushBytes(buf []byte) (written int, err error) {
+	s.counters.touch()
 	s.bufferLock.Lock()
 	s.buffers = append(s.buffers, buf)
 	s.heads = append(s.heads, buf)
@@ -513,6 +766,22 @@ func (s *Stream) recycleTokens() (n int) {
 	return
 }
 
+// discardWindow acknowledges n bytes discarded once the reading side is shut
+// down, so that a peer which can't be told to stop keeps on sending rather
+// than stalling on its window. It doesn't block, recvLoop calls it.
+func (s *Stream) discardWindow(n int) {
+	if n == 0 || s.sess.version() < 2 || s.sess.peerExtended() {
+		return
+	}
+	s.bufferLock.Lock()
+	defer s.bufferLock.Unlock()
+	s.numRead += uint32(n)
+	s.incr += uint32(n)
+	if s.incr >= uint32(s.sess.config.MaxStreamBuffer/2) && s.sess.sendControl(s.windowUpdate(s.numRead)) {
+		s.incr = 0 // or retried with the next bytes discarded
+	}
+}
+
 // notify read event
 func (s *Stream) notifyReadEvent() {
 	select {
@@ -537,3 +806,10 @@ func (s *Stream) fin() {
 		close(s.chFinEvent)
 	})
 }
+
+// mark the remote peer has stopped receiving
+func (s *Stream) stop() {
+	s.stopEventOnce.Do(func() {
+		close(s.chStopEvent)
+	})
+}